@@ -0,0 +1,69 @@
+package scpw
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"path/filepath"
+)
+
+// exitIsDir is the exit status of the rename script when the target is a directory
+const exitIsDir = 3
+
+// AtomicName returns a hidden temp name next to the remote path dst.
+func AtomicName(dst string) string {
+	dst = filepath.Clean(dst)
+	return filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.scpw-%s", filepath.Base(dst), uuid.NewString()))
+}
+
+// putAtomic uploads srcPath to a temp name in the destination directory and
+// renames it to dstPath, so nobody watching the directory sees a partial file.
+// dstPath must not be a directory, mv would move the temp inside it.
+func (scp *SCP) putAtomic(ctx Context, srcPath, dstPath string) error {
+	ctx.Atomic = false
+	tmp := AtomicName(dstPath)
+	if err := scp.Put(ctx, srcPath, tmp); err != nil {
+		scp.cleanRemote(tmp)
+		return err
+	}
+	script := fmt.Sprintf("[ ! -d %[2]q ] || exit %[3]d; mv -f %[1]q %[2]q", tmp, dstPath, exitIsDir)
+	if out, err := scp.Exec(script); err != nil {
+		scp.cleanRemote(tmp)
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == exitIsDir {
+			return fmt.Errorf("remote:[%s] is a directory, atomic upload of a file needs the full target path", dstPath)
+		}
+		return fmt.Errorf("rename remote:[%s] failed! e: %v %s", dstPath, err, out)
+	}
+	return nil
+}
+
+// putAllAtomic uploads the srcPath tree into a hidden temp dir under dstPath and
+// swaps it with the previous tree, the previous tree is restored if the swap fails.
+// The swap is two renames, the target is missing for the short time between them.
+func (scp *SCP) putAllAtomic(ctx Context, srcPath, dstPath string) error {
+	ctx.Atomic = false
+	tmp := AtomicName(filepath.Join(dstPath, filepath.Base(srcPath)))
+	if out, err := scp.Exec(fmt.Sprintf("mkdir %q", tmp)); err != nil {
+		return fmt.Errorf("mkdir remote:[%s] failed! e: %v %s", tmp, err, out)
+	}
+	if err := scp.PutAll(ctx, srcPath, tmp); err != nil {
+		scp.cleanRemote(tmp)
+		return err
+	}
+	final := filepath.Join(dstPath, filepath.Base(srcPath))
+	uploaded, old := filepath.Join(tmp, filepath.Base(srcPath)), filepath.Join(tmp, ".old")
+	script := fmt.Sprintf("{ [ ! -e %[1]q ] || mv %[1]q %[2]q; } && { mv %[3]q %[1]q || { [ ! -e %[2]q ] || mv %[2]q %[1]q; false; }; }; rc=$?; rm -rf %[4]q; exit $rc",
+		final, old, uploaded, tmp)
+	if out, err := scp.Exec(script); err != nil {
+		return fmt.Errorf("rename remote:[%s] failed! e: %v %s", final, err, out)
+	}
+	return nil
+}
+
+func (scp *SCP) cleanRemote(path string) {
+	if out, err := scp.Exec(fmt.Sprintf("rm -rf %q", path)); err != nil {
+		log.Warnf("clean remote:[%s] failed! e: %v %s", path, err, out)
+	}
+}
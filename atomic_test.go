@@ -0,0 +1,63 @@
+package scpw
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAtomicName(t *testing.T) {
+	name := AtomicName("/tmp/a/app.bin")
+	assert.Equal(t, "/tmp/a", filepath.Dir(name))
+	assert.True(t, strings.HasPrefix(filepath.Base(name), ".app.bin.scpw-"))
+	assert.NotEqual(t, name, AtomicName("/tmp/a/app.bin"))
+
+	assert.Equal(t, "/tmp/a", filepath.Dir(AtomicName("/tmp/a/dir/")))
+}
+
+func TestAtomicOf(t *testing.T) {
+	assert.False(t, (&Node{}).AtomicOf(LRMap{}))
+	assert.True(t, (&Node{Atomic: true}).AtomicOf(LRMap{}))
+	on, off := true, false
+	assert.True(t, (&Node{}).AtomicOf(LRMap{Atomic: &on}))
+	assert.False(t, (&Node{Atomic: true}).AtomicOf(LRMap{Atomic: &off}))
+}
+
+func TestPutAtomic(t *testing.T) {
+	p := NewProgress()
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar(""), Atomic: true}
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	local, remote := RandName(tmpDir), RandName(tmpDir)
+	require.Nil(t, writeFile(local))
+	require.Nil(t, scpwCli.Put(ctx, local, remote))
+	assertSameFile(t, local, remote)
+
+	// replace an existing tree
+	remoteDir := RandName(tmpDir)
+	require.Nil(t, mkdir(remoteDir))
+	require.Nil(t, scpwCli.PutAll(ctx, baseLocalDir, remoteDir))
+	require.Nil(t, scpwCli.PutAll(ctx, baseLocalDir, remoteDir))
+	assertSameFile(t, filepath.Join(baseLocalDir, "a"), filepath.Join(remoteDir, filepath.Base(baseLocalDir), "a"))
+	entries, err := os.ReadDir(remoteDir)
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	// temp is cleaned on failure
+	assert.NotNil(t, scpwCli.Put(ctx, local, filepath.Join(tmpDir, "not-exist", "a")))
+
+	// a directory target is not replaced by the file
+	err = scpwCli.Put(ctx, local, remoteDir)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is a directory")
+	entries, err = os.ReadDir(remoteDir)
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
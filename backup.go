@@ -0,0 +1,234 @@
+package scpw
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BackupPolicy = string
+
+const (
+	BackupNone        BackupPolicy = "none"
+	BackupKeepLast    BackupPolicy = "keep-last"
+	BackupTimestamped BackupPolicy = "timestamped"
+)
+
+const (
+	backupSuffix     = ".scpw-bak."
+	backupTimeFormat = "20060102150405.000"
+)
+
+// Backup decides what happens to a local file or dir replaced by GET.
+// The zero value keeps the last backup only.
+type Backup struct {
+	Policy BackupPolicy
+	N      int
+	Dir    string
+}
+
+// ParseBackup parses `none`, `keep-last-N` or `timestamped`, empty means `keep-last-1`.
+func ParseBackup(policy, dir string) (Backup, error) {
+	b := Backup{Policy: policy, Dir: dir}
+	switch {
+	case policy == "":
+		b.Policy, b.N = BackupKeepLast, 1
+	case policy == BackupNone, policy == BackupTimestamped:
+	case strings.HasPrefix(policy, BackupKeepLast+"-"):
+		n, err := strconv.Atoi(strings.TrimPrefix(policy, BackupKeepLast+"-"))
+		if err != nil || n < 1 {
+			return b, fmt.Errorf("invalid backup policy:[%s]", policy)
+		}
+		b.Policy, b.N = BackupKeepLast, n
+	default:
+		return b, fmt.Errorf("invalid backup policy:[%s]", policy)
+	}
+	return b, nil
+}
+
+// keep returns how many backups survive pruning, -1 means all of them.
+func (b Backup) keep() int {
+	switch b.Policy {
+	case BackupNone:
+		return 0
+	case BackupTimestamped:
+		return -1
+	case BackupKeepLast:
+		return b.N
+	default:
+		return 1
+	}
+}
+
+func (b Backup) dir(path string) string {
+	if b.Dir != "" {
+		return b.Dir
+	}
+	return filepath.Dir(filepath.Clean(path))
+}
+
+// base is what the backup names of path start with. Files of different
+// directories share a backup-dir, so the name carries a hash of the full path there.
+func (b Backup) base(path string) string {
+	path = filepath.Clean(path)
+	name := filepath.Base(path)
+	if b.Dir == "" {
+		return name
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	sum := sha256.Sum256([]byte(path))
+	return fmt.Sprintf("%s.%x", name, sum[:4])
+}
+
+func (b Backup) Name(path string, now time.Time) string {
+	return filepath.Join(b.dir(path), b.base(path)+backupSuffix+now.Format(backupTimeFormat))
+}
+
+// Save moves path aside to its backup name, a missing path is not an error.
+func (b Backup) Save(path string) (string, error) {
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if b.Dir != "" {
+		if err := os.MkdirAll(b.Dir, os.FileMode(0755)); err != nil {
+			return "", err
+		}
+	}
+	name := b.Name(path, time.Now())
+	return name, move(path, name)
+}
+
+// Restore moves the backup name back to path after the replacement failed.
+func (b Backup) Restore(name, path string) error {
+	if name == "" {
+		return nil
+	}
+	return move(name, path)
+}
+
+// List returns the backups of path, oldest first.
+func (b Backup) List(path string) ([]string, error) {
+	prefix := b.base(path) + backupSuffix
+	entries, err := os.ReadDir(b.dir(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) {
+			list = append(list, filepath.Join(b.dir(path), entry.Name()))
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// Prune removes the oldest backups of path beyond the policy.
+func (b Backup) Prune(path string) error {
+	keep := b.keep()
+	if keep < 0 {
+		return nil
+	}
+	list, err := b.List(path)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(list)-keep; i++ {
+		if err = os.RemoveAll(list[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move renames src to dst, a backup-dir on another filesystem gets a copy and src is removed.
+func move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !crossDevice(err) {
+		return err
+	}
+	if err = copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("copy [%s] to [%s] failed! e: %v", src, dst, err)
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies the file, link or dir src to dst with its modes and times.
+func copyTree(src, dst string) error {
+	var dirs []string
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, path)
+			return os.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			if err = copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		default:
+			return fmt.Errorf("[%s] is not a regular file or dir", path)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// a dir gets its time once its entries are written
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(dirs[i])
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, dirs[i])
+		if err = os.Chtimes(filepath.Join(dst, rel), info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
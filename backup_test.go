@@ -0,0 +1,137 @@
+package scpw
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBackup(t *testing.T) {
+	b, err := ParseBackup("", "")
+	require.Nil(t, err)
+	assert.Equal(t, 1, b.keep())
+
+	b, err = ParseBackup("keep-last-3", "/tmp/bak")
+	require.Nil(t, err)
+	assert.Equal(t, 3, b.keep())
+	assert.Equal(t, "/tmp/bak", b.Dir)
+
+	b, err = ParseBackup("none", "")
+	require.Nil(t, err)
+	assert.Equal(t, 0, b.keep())
+
+	b, err = ParseBackup("timestamped", "")
+	require.Nil(t, err)
+	assert.Equal(t, -1, b.keep())
+
+	for _, policy := range []string{"keep-last-0", "keep-last-x", "always"} {
+		_, err = ParseBackup(policy, "")
+		assert.NotNil(t, err, policy)
+	}
+
+	assert.Equal(t, 1, Backup{}.keep())
+}
+
+func TestBackupName(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.Local)
+	assert.Equal(t, "/tmp/a.conf.scpw-bak.20230102030405.000", Backup{}.Name("/tmp/a.conf", now))
+
+	// a shared backup-dir keeps the files of different dirs apart
+	shared := Backup{Dir: "/bak"}
+	name := shared.Name("/tmp/lib/", now)
+	assert.Equal(t, "/bak", filepath.Dir(name))
+	assert.Regexp(t, `^lib\.[0-9a-f]{8}\.scpw-bak\.20230102030405\.000$`, filepath.Base(name))
+	assert.Equal(t, name, shared.Name("/tmp/lib", now))
+	assert.NotEqual(t, name, shared.Name("/opt/lib", now))
+}
+
+func TestBackupSharedDir(t *testing.T) {
+	root := t.TempDir()
+	b, err := ParseBackup("keep-last-1", filepath.Join(root, "bak"))
+	require.Nil(t, err)
+	a, c := filepath.Join(root, "a", "app.conf"), filepath.Join(root, "c", "app.conf")
+	require.Nil(t, os.MkdirAll(filepath.Dir(a), 0755))
+	require.Nil(t, os.MkdirAll(filepath.Dir(c), 0755))
+	for _, local := range []string{a, c} {
+		require.Nil(t, writeFile(local))
+		_, err = b.Save(local)
+		require.Nil(t, err)
+		require.Nil(t, b.Prune(local))
+	}
+	for _, local := range []string{a, c} {
+		list, err := b.List(local)
+		require.Nil(t, err)
+		assert.Len(t, list, 1, local)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	root := t.TempDir()
+	src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	require.Nil(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	require.Nil(t, writeFile(filepath.Join(src, "sub", "a")))
+	require.Nil(t, os.Symlink("sub/a", filepath.Join(src, "link")))
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.Nil(t, os.Chtimes(filepath.Join(src, "sub", "a"), old, old))
+	require.Nil(t, os.Chtimes(filepath.Join(src, "sub"), old, old))
+
+	require.Nil(t, copyTree(src, dst))
+	assertSameFile(t, filepath.Join(src, "sub", "a"), filepath.Join(dst, "sub", "a"))
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	require.Nil(t, err)
+	assert.Equal(t, "sub/a", link)
+	for _, name := range []string{"sub", "sub/a"} {
+		info, err := os.Stat(filepath.Join(dst, name))
+		require.Nil(t, err)
+		assert.True(t, old.Equal(info.ModTime()), name)
+	}
+}
+
+func TestBackupSavePrune(t *testing.T) {
+	root := t.TempDir()
+	local := filepath.Join(root, "a.conf")
+	b, err := ParseBackup("keep-last-2", filepath.Join(root, "bak"))
+	require.Nil(t, err)
+
+	name, err := b.Save(local)
+	require.Nil(t, err)
+	assert.Equal(t, "", name)
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, writeFile(local))
+		_, err = b.Save(local)
+		require.Nil(t, err)
+		time.Sleep(2 * time.Millisecond)
+	}
+	list, err := b.List(local)
+	require.Nil(t, err)
+	assert.Len(t, list, 3)
+
+	require.Nil(t, b.Prune(local))
+	pruned, err := b.List(local)
+	require.Nil(t, err)
+	assert.Equal(t, list[1:], pruned)
+	_, err = os.Stat(local)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReplace(t *testing.T) {
+	root := t.TempDir()
+	local, tmp := filepath.Join(root, "a.conf"), filepath.Join(root, "tmp")
+	require.Nil(t, writeFile(local))
+	require.Nil(t, writeFile(tmp))
+	scp := &SCP{}
+	require.Nil(t, scp.replace(Context{Backup: Backup{Policy: BackupNone}}, tmp, local))
+	entries, err := os.ReadDir(root)
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	// the original is back when the new file can't be moved in
+	err = scp.replace(Context{}, filepath.Join(root, "missing"), local)
+	assert.NotNil(t, err)
+	_, err = os.Stat(local)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,155 @@
+package scpw
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// chunkThreshold is the smallest file uploaded in chunks, smaller files gain
+// nothing from more sessions.
+var chunkThreshold int64 = 64 * 1024 * 1024
+
+// chunkBlock is the dd block size, every chunk starts at a multiple of it.
+var chunkBlock int64 = 1024 * 1024
+
+func (ctx Context) chunked(size int64) bool {
+	return ctx.Chunks > 1 && size >= chunkThreshold
+}
+
+// chunkSize splits size into n ranges aligned to chunkBlock.
+func chunkSize(size int64, n int) int64 {
+	chunk := (size + int64(n) - 1) / int64(n)
+	return (chunk + chunkBlock - 1) / chunkBlock * chunkBlock
+}
+
+// putChunked uploads ranges of srcPath concurrently, each over its own session
+// with remote `dd seek=` into a temp file. The temp is checked for size and,
+// with Verify, checksum before it is renamed to dstPath.
+func (scp *SCP) putChunked(ctx Context, srcPath, dstPath string, stat os.FileInfo) error {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tmp := AtomicName(dstPath)
+	if out, err := scp.Exec(fmt.Sprintf(": > %q", tmp)); err != nil {
+		return fmt.Errorf("create remote:[%s] failed! e: %v %s", tmp, err, out)
+	}
+
+	size, chunk := stat.Size(), chunkSize(stat.Size(), ctx.Chunks)
+	// the chunks share one line
+	var f *FileBar
+	if ctx.Tracker != nil {
+		f = ctx.Tracker.Start(filepath.Base(dstPath), size)
+	}
+	errChan := make(chan error, ctx.Chunks+1)
+	wg := sync.WaitGroup{}
+	for off := int64(0); off < size; off += chunk {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			if err := scp.putChunk(ctx, f, file, tmp, off, MinInt64(chunk, size-off)); err != nil {
+				errChan <- err
+			}
+		}(off)
+	}
+	// hash the file while the chunks are on the wire
+	var sum string
+	if ctx.Verify != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h, err := ctx.newHash()
+			if err == nil {
+				_, err = io.Copy(h, io.NewSectionReader(file, 0, size))
+			}
+			if err != nil {
+				errChan <- err
+				return
+			}
+			sum = sumOf(h)
+		}()
+	}
+	wg.Wait()
+	close(errChan)
+	err = <-errChan
+	if f != nil {
+		f.Finish(err)
+	}
+	if err != nil {
+		scp.cleanRemote(tmp)
+		return err
+	}
+
+	if err = scp.checkSize(tmp, size); err == nil && sum != "" {
+		err = scp.verify(ctx.Verify, []checksum{{remote: tmp, sum: sum}})
+	}
+	if err != nil {
+		scp.cleanRemote(tmp)
+		return err
+	}
+	cmd := fmt.Sprintf("chmod %04o %q", stat.Mode().Perm(), tmp)
+	if scp.KeepTime {
+		cmd += " && " + touchCommand(tmp, stat.ModTime())
+	}
+	cmd += fmt.Sprintf(" && mv -f %q %q", tmp, dstPath)
+	if out, err := scp.Exec(cmd); err != nil {
+		scp.cleanRemote(tmp)
+		return fmt.Errorf("rename remote:[%s] failed! e: %v %s", dstPath, err, out)
+	}
+	return nil
+}
+
+// putChunk writes n bytes of file at off into the same offset of the remote tmp,
+// reported to f when there is a tracker.
+func (scp *SCP) putChunk(ctx Context, f *FileBar, file *os.File, tmp string, off, n int64) error {
+	session, stop, err := scp.newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer stop()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &strings.Builder{}
+	session.Stderr = stderr
+	// conv=notrunc keeps the ranges written by the other sessions
+	cmd := fmt.Sprintf("dd of=%q bs=%d seek=%d conv=notrunc", tmp, chunkBlock, off/chunkBlock)
+	if err = session.Start(cmd); err != nil {
+		return err
+	}
+	in := ctx.limit(io.NewSectionReader(file, off, n))
+	if f != nil {
+		_, err = io.CopyN(stdin, f.Reader(in), n)
+	} else {
+		err = parseContent(ctx.Bar, stdin, in, n)
+	}
+	stdin.Close()
+	if e := session.Wait(); err == nil && e != nil {
+		err = fmt.Errorf("remote dd failed! offset: %d e: %v %s", off, e, stderr.String())
+	}
+	return err
+}
+
+// checkSize compares the size of a remote file with size.
+func (scp *SCP) checkSize(remote string, size int64) error {
+	out, err := scp.Output(fmt.Sprintf("wc -c < %q", remote))
+	if err != nil {
+		return fmt.Errorf("remote wc failed! e: %v", err)
+	}
+	got, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size of remote:[%s] %q", remote, out)
+	}
+	if got != size {
+		return fmt.Errorf("size of remote:[%s] is %d, expect %d", remote, got, size)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package scpw
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkSize(t *testing.T) {
+	block := chunkBlock
+	defer func() { chunkBlock = block }()
+	chunkBlock = 4
+
+	assert.Equal(t, int64(8), chunkSize(30, 4))
+	assert.Equal(t, int64(4), chunkSize(4, 4))
+	assert.Equal(t, int64(12), chunkSize(30, 3))
+}
+
+func TestChunksOf(t *testing.T) {
+	assert.Equal(t, 0, (&Node{}).ChunksOf(LRMap{}))
+	assert.Equal(t, 4, (&Node{Chunks: 4}).ChunksOf(LRMap{}))
+	assert.Equal(t, 2, (&Node{Chunks: 4}).ChunksOf(LRMap{Chunks: 2}))
+}
+
+func TestPutChunked(t *testing.T) {
+	threshold, block := chunkThreshold, chunkBlock
+	defer func() { chunkThreshold, chunkBlock = threshold, block }()
+	chunkThreshold, chunkBlock = 1, 4096
+
+	content := make([]byte, 10*4096+123)
+	_, err := rand.Read(content)
+	require.Nil(t, err)
+	local := RandName(tmpDir)
+	require.Nil(t, os.WriteFile(local, content, 0640))
+
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+	p := NewProgress()
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar(""), Verify: SHA256, Chunks: 4}
+
+	remoteDir := RandName(tmpDir)
+	require.Nil(t, mkdir(remoteDir))
+	remote := filepath.Join(remoteDir, "image")
+	require.Nil(t, scpwCli.Put(ctx, local, remote))
+	assertSameFile(t, local, remote)
+
+	// overwrite
+	require.Nil(t, scpwCli.Put(ctx, local, remote))
+	assertSameFile(t, local, remote)
+	entries, err := os.ReadDir(remoteDir)
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.NotNil(t, scpwCli.Put(ctx, local, filepath.Join(tmpDir, "not-exist", "image")))
+}
+
+func TestCheckSize(t *testing.T) {
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	remote := RandName(tmpDir)
+	require.Nil(t, writeFile(remote))
+	assert.Nil(t, scpwCli.checkSize(remote, 4))
+	assert.NotNil(t, scpwCli.checkSize(remote, 5))
+	assert.NotNil(t, scpwCli.checkSize(filepath.Join(tmpDir, "not-exist"), 0))
+}
@@ -1,25 +1,53 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/T-TRz879/scpw"
 	"github.com/google/gops/agent"
 	"github.com/manifoldco/promptui"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 )
 
 const (
 	cliName        = "scpw"
 	cliDescription = "Simplify scp operations"
-	threads        = 10
 )
 
+// startups caps the SSH handshakes in flight over all nodes, sshd drops
+// connections beyond its MaxStartups.
+var startups chan struct{}
+
+func dial(node *scpw.Node) (*ssh.Client, error) {
+	if startups != nil {
+		startups <- struct{}{}
+		defer func() { <-startups }()
+	}
+	return scpw.NewSSH(node)
+}
+
 func main() {
+	// the first Ctrl-C cancels the transfers and cleans up, a second one kills
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 	if err := agent.Listen(agent.Options{
-		ShutdownCleanup: true, // automatically closes on os.Interrupt
+		ShutdownCleanup: false, // os.Interrupt is handled by ctx
 	}); err != nil {
 		log.Fatal(err)
 	}
@@ -31,36 +59,196 @@ func main() {
 		Name:  cliName,
 		Usage: cliDescription,
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name: "config", Aliases: []string{"c"},
+				Usage:   "config files separated by " + string(os.PathListSeparator) + ", later files override the nodes of earlier ones",
+				EnvVars: []string{"SCPW_CONFIG"},
+			},
+			&cli.StringFlag{
+				Name:    "key-file",
+				Usage:   "file with the passphrase of encrypted configs, asked on the terminal without it",
+				EnvVars: []string{"SCPW_KEY_FILE"},
+			},
 			&cli.BoolFlag{
 				Name:  "keep-time",
 				Usage: "keep file or dir atime and mtime",
 				Value: true,
 			},
+			&cli.Int64Flag{
+				Name:  "bwlimit",
+				Usage: "limit the bandwidth of all transfers in KB/s",
+			},
+			&cli.BoolFlag{
+				Name: "quiet", Aliases: []string{"q"},
+				Usage: "print warnings and errors only, same as --progress=none",
+			},
+			&cli.StringFlag{
+				Name:  "progress",
+				Usage: "bars, plain (a line every 10s) or none, bars on a terminal and plain otherwise by default",
+			},
+			&cli.IntFlag{
+				Name: "jobs", Aliases: []string{"j"},
+				Usage: "connections per node unless the node sets concurrency",
+				Value: 10,
+			},
+			&cli.IntFlag{
+				Name:  "max-startups",
+				Usage: "SSH handshakes in flight over all nodes, 0 for no limit",
+				Value: 10,
+			},
+		},
+		Before: setup,
+		Commands: []*cli.Command{
+			{
+				Name:      "rollback",
+				Usage:     "restore the most recent remote backup set of a node",
+				ArgsUsage: "<node>",
+				Action:    Rollback,
+			},
+			{
+				Name:  "config",
+				Usage: "inspect, encrypt or edit the config",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "check",
+						Usage:  "validate the config and print the file it was loaded from",
+						Action: ConfigCheck,
+					},
+					{
+						Name:      "show",
+						Usage:     "print the effective config of all nodes or one, passwords masked",
+						ArgsUsage: "[node]",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "format",
+								Aliases: []string{"o"},
+								Value:   scpw.YAML,
+								Usage:   "output format, " + strings.Join(scpw.ConfigFormats, ", "),
+							},
+						},
+						Action: ConfigShow,
+					},
+					{
+						Name:      "encrypt",
+						Usage:     "encrypt a config, the default one without file, into <file>.enc",
+						ArgsUsage: "[file]",
+						Action:    ConfigEncrypt,
+					},
+					{
+						Name:      "decrypt",
+						Usage:     "decrypt a <file>.enc config, the default one without file",
+						ArgsUsage: "[file.enc]",
+						Action:    ConfigDecrypt,
+					},
+					{
+						Name:      "edit",
+						Usage:     "edit an encrypted config in $EDITOR, it is validated and encrypted again",
+						ArgsUsage: "[file.enc]",
+						Action:    ConfigEdit,
+					},
+				},
+			},
+			{
+				Name:  "vault",
+				Usage: "manage the secrets of password-secret: vault:<key>, in $SCPW_VAULT or ~/.scpw.vault",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "set",
+						Usage:     "store a secret, read from the terminal or the first line of stdin",
+						ArgsUsage: "<key>",
+						Action:    VaultSet,
+					},
+					{
+						Name:      "rm",
+						Usage:     "remove a secret",
+						ArgsUsage: "<key>",
+						Action:    VaultRemove,
+					},
+					{
+						Name:   "list",
+						Usage:  "print the keys of the secrets",
+						Action: VaultList,
+					},
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "serve a directory over the scp protocol",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "listen", Usage: "listen address", Value: ":2222"},
+					&cli.StringFlag{Name: "root", Usage: "directory exposed to clients", Required: true},
+					&cli.StringFlag{Name: "authorized-keys", Usage: "authorized_keys file of allowed clients", Required: true},
+					&cli.StringFlag{Name: "host-key", Usage: "host private key, an ephemeral key is used when empty"},
+					&cli.StringFlag{Name: "mode", Usage: "rw, ro (download only) or wo (upload only)", Value: scpw.ServeReadWrite},
+				},
+				Action: Serve,
+			},
 		},
 		Action:               Run,
 		HideHelpCommand:      true,
 		EnableBashCompletion: true,
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	if err := app.RunContext(ctx, os.Args); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// readConfig loads the files of --config, or the default config without it.
+func readConfig(ctx *cli.Context) (*scpw.Config, error) {
+	var paths []string
+	for _, path := range filepath.SplitList(ctx.String("config")) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return scpw.ReadConfig(paths...)
+}
+
+// progressMode resolves --quiet and --progress, bars need a terminal.
+func progressMode(ctx *cli.Context) scpw.ProgressMode {
+	if ctx.Bool("quiet") {
+		return scpw.ProgressNone
+	}
+	if mode := ctx.String("progress"); mode != "" {
+		return mode
+	}
+	if scpw.IsTerminal(os.Stdout) {
+		return scpw.ProgressBars
+	}
+	return scpw.ProgressPlain
+}
+
+func setup(ctx *cli.Context) error {
+	scpw.ConfigKeyFile = ctx.String("key-file")
+	if n := ctx.Int("max-startups"); n > 0 {
+		startups = make(chan struct{}, n)
+	}
+	if progressMode(ctx) != scpw.ProgressBars || !scpw.IsTerminal(os.Stderr) {
+		scpw.DisableLogColor()
+	}
+	if ctx.Bool("quiet") {
+		scpw.SetLogLevel(logrus.WarnLevel)
+	}
+	return nil
+}
+
 func Run(ctx *cli.Context) error {
-	nodes, err := scpw.LoadConfig()
+	config, err := readConfig(ctx)
 	if err != nil {
 		return err
 	}
+	// children are picked by their group path, picking a group runs them
+	nodes := scpw.NodeChoices(config.Nodes)
 
 	templates := &promptui.SelectTemplates{
 		Label:    "{{ . }}?",
-		Active:   "🎈 {{ .Name | cyan }} ({{ .Host | red }} - {{ .Typ | green }})",
-		Inactive: "  {{ .Name | cyan }} ({{ .Host | red }} - {{ .Typ | green }})",
-		Selected: " {{ .Name | red | cyan }} ({{ .Host | red }} - {{ .Typ | green }})",
+		Active:   "🎈 {{ .Path | cyan }} ({{ .Host | red }} - {{ .Typ | green }})",
+		Inactive: "  {{ .Path | cyan }} ({{ .Host | red }} - {{ .Typ | green }})",
+		Selected: " {{ .Path | red | cyan }} ({{ .Host | red }} - {{ .Typ | green }})",
 		Details: `
 --------- SCPW Config ----------
-{{ "Name:" | faint }}	{{ .Name }}
+{{ "Name:" | faint }}	{{ .Path }}
 {{ "Address:" | faint }}	{{ .Host }}{{":"}}{{ .Port }}
 {{ "User:" | faint }}	{{ .User }}
 {{ "Type:" | faint }}   {{ .Typ }}
@@ -72,7 +260,7 @@ func Run(ctx *cli.Context) error {
 
 	searcher := func(input string, index int) bool {
 		pepper := nodes[index]
-		name := strings.Replace(strings.ToLower(pepper.Name), " ", "", -1)
+		name := strings.Replace(strings.ToLower(pepper.Path), " ", "", -1)
 		input = strings.Replace(strings.ToLower(input), " ", "", -1)
 
 		return strings.Contains(name, input)
@@ -90,42 +278,521 @@ func Run(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	return initScpCli(ctx, nodes[i])
+	targets := nodes[i].Runnable()
+	if len(targets) == 0 {
+		return fmt.Errorf("node:[%s] has nothing to transfer", nodes[i].Path)
+	}
+	p, err := scpw.NewProgressMode(progressMode(ctx), os.Stdout)
+	if err != nil {
+		return err
+	}
+	// the nodes of a group share --bwlimit and --max-startups
+	global := scpw.NewLimiter(ctx.Int64("bwlimit"))
+	reports := make([]*report, len(targets))
+	errs := make([]error, len(targets))
+	wg := sync.WaitGroup{}
+	for i, node := range targets {
+		reports[i] = &report{node: node.Name}
+		wg.Add(1)
+		go func(i int, node *scpw.Node) {
+			defer wg.Done()
+			errs[i] = initScpCli(ctx, node, global, p, reports[i])
+		}(i, node)
+	}
+	wg.Wait()
+	p.Wait()
+	if ctx.Context.Err() != nil {
+		for _, r := range reports {
+			r.print()
+		}
+		return ctx.Context.Err()
+	}
+	if len(targets) == 1 {
+		return errs[0]
+	}
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("node:[%s] %v", targets[i].Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// report is what a node completed, printed when the run is interrupted.
+type report struct {
+	node      string
+	total     int
+	completed []string
+	cancelled int
+}
+
+func (r *report) print() {
+	fmt.Printf("interrupted, %d of %d transfers of node:[%s] completed, %d cancelled\n", len(r.completed), r.total, r.node, r.cancelled)
+	for _, c := range r.completed {
+		fmt.Printf("    completed %s\n", c)
+	}
+}
+
+func Rollback(ctx *cli.Context) error {
+	name := ctx.Args().First()
+	if name == "" {
+		return fmt.Errorf("missing node name")
+	}
+	config, err := readConfig(ctx)
+	if err != nil {
+		return err
+	}
+	nodes := config.Nodes
+	node := scpw.FindNode(nodes, name)
+	if node == nil {
+		return fmt.Errorf("node:[%s] not found", name)
+	}
+	targets, err := node.PutTargets()
+	if err != nil {
+		return err
+	}
+	ssh, err := dial(node)
+	if err != nil {
+		return err
+	}
+	defer ssh.Close()
+	stamp, restored, removed, err := scpw.NewSCP(ssh, false).Rollback(scpw.RemoteBackup{Dir: node.RemoteBackupDir}, targets)
+	if err != nil {
+		return err
+	}
+	for _, target := range restored {
+		fmt.Printf("restored %s from backup %s\n", target, stamp)
+	}
+	for _, target := range removed {
+		fmt.Printf("removed %s, created after backup %s\n", target, stamp)
+	}
+	return nil
+}
+
+func ConfigCheck(ctx *cli.Context) error {
+	config, err := readConfig(ctx)
+	if err != nil {
+		return err
+	}
+	count := 0
+	var walk func(nodes []*scpw.Node)
+	walk = func(nodes []*scpw.Node) {
+		for _, node := range nodes {
+			count++
+			walk(node.Children)
+		}
+	}
+	walk(config.Nodes)
+	fmt.Printf("%s: ok, %d nodes\n", strings.Join(config.Paths, ", "), count)
+	return nil
+}
+
+// ConfigShow prints the config as the transfers see it, children with what
+// they inherit from their parents.
+func ConfigShow(ctx *cli.Context) error {
+	config, err := readConfig(ctx)
+	if err != nil {
+		return err
+	}
+	nodes := config.Nodes
+	if name := ctx.Args().First(); name != "" {
+		node := scpw.FindNode(nodes, name)
+		if node == nil {
+			return fmt.Errorf("node:[%s] not found", name)
+		}
+		nodes = []*scpw.Node{node}
+	}
+	format := ctx.String("format")
+	var b bytes.Buffer
+	if err = scpw.WriteConfigAs(&b, scpw.Masked(nodes), format); err != nil {
+		return err
+	}
+	// JSON has no comments
+	out := os.Stdout
+	if format == scpw.JSON {
+		out = os.Stderr
+	}
+	for _, path := range config.Paths {
+		fmt.Fprintf(out, "# %s\n", path)
+	}
+	_, err = b.WriteTo(os.Stdout)
+	return err
+}
+
+// configFile is the file argument of a config command, or the default config.
+func configFile(ctx *cli.Context) (string, error) {
+	if path := ctx.Args().First(); path != "" {
+		return path, nil
+	}
+	return scpw.FindConfigFile(scpw.ConfigNames...)
+}
+
+func ConfigEncrypt(ctx *cli.Context) error {
+	path, err := configFile(ctx)
+	if err != nil {
+		return err
+	}
+	dst, err := scpw.EncryptConfigFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("encrypted %s into %s\n", path, dst)
+	return nil
+}
+
+func ConfigDecrypt(ctx *cli.Context) error {
+	path, err := configFile(ctx)
+	if err != nil {
+		return err
+	}
+	dst, err := scpw.DecryptConfigFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("decrypted %s into %s\n", path, dst)
+	return nil
+}
+
+// ConfigEdit decrypts a config into a private temp dir for $EDITOR, and
+// encrypts it again once it is valid.
+func ConfigEdit(ctx *cli.Context) error {
+	path, err := configFile(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(path, scpw.EncryptedExt) {
+		return fmt.Errorf("config:[%s] is not encrypted, edit it directly", path)
+	}
+	var plaintext []byte
+	if _, err = os.Stat(path); err == nil {
+		if plaintext, err = scpw.ReadConfigData(path); err != nil {
+			return err
+		}
+	}
+	dir, err := os.MkdirTemp("", "scpw-edit-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// keep .yml for the syntax of the editor
+	tmp := filepath.Join(dir, strings.TrimSuffix(filepath.Base(path), scpw.EncryptedExt))
+	if err = os.WriteFile(tmp, plaintext, 0600); err != nil {
+		return err
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		c := scpw.ShellCommand(fmt.Sprintf("%s %q", editor, tmp))
+		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err = c.Run(); err != nil {
+			return fmt.Errorf("editor:[%s] failed! e: %v", editor, err)
+		}
+		edited, err := os.ReadFile(tmp)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(edited, plaintext) {
+			fmt.Println("no changes")
+			return nil
+		}
+		if _, err = scpw.ParseConfig(path, edited); err == nil {
+			return scpw.WriteConfigData(path, edited)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprint(os.Stderr, "edit again? [Y/n] ")
+		if answer, err := in.ReadString('\n'); err != nil || strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "n") {
+			return fmt.Errorf("config:[%s] not saved", path)
+		}
+	}
+}
+
+func VaultSet(ctx *cli.Context) error {
+	key := ctx.Args().First()
+	if key == "" {
+		return fmt.Errorf("missing secret key")
+	}
+	var secret string
+	if scpw.IsTerminal(os.Stdin) {
+		b, err := scpw.ReadPassphrase(fmt.Sprintf("secret of %s: ", key), false)
+		if err != nil {
+			return err
+		}
+		secret = string(b)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		secret = strings.TrimRight(line, "\r\n")
+	}
+	if secret == "" {
+		return fmt.Errorf("empty secret")
+	}
+	return scpw.DefaultVault.Set(key, secret)
+}
+
+func VaultRemove(ctx *cli.Context) error {
+	key := ctx.Args().First()
+	if key == "" {
+		return fmt.Errorf("missing secret key")
+	}
+	return scpw.DefaultVault.Delete(key)
+}
+
+func VaultList(ctx *cli.Context) error {
+	keys, err := scpw.DefaultVault.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+	return nil
+}
+
+func Serve(ctx *cli.Context) error {
+	server, err := scpw.NewServer(scpw.ServerConfig{
+		Root:           ctx.String("root"),
+		AuthorizedKeys: ctx.String("authorized-keys"),
+		HostKey:        ctx.String("host-key"),
+		Mode:           ctx.String("mode"),
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Context.Done()
+		server.Close()
+	}()
+	if err = server.ListenAndServe(ctx.String("listen")); ctx.Context.Err() != nil {
+		return nil
+	}
+	return err
 }
 
-func initScpCli(ctx *cli.Context, node *scpw.Node) error {
-	p := scpw.NewProgress()
+// backupRemote copies the remote targets of a PUT node before they are overwritten.
+func backupRemote(dialControl func() (*scpw.SCP, error), node *scpw.Node) error {
+	targets, err := node.PutTargets()
+	if err != nil {
+		return err
+	}
+	control, err := dialControl()
+	if err != nil {
+		return err
+	}
+	return control.BackupRemote(scpw.NewRemoteBackup(node.RemoteBackupDir), targets)
+}
+
+// detectCodec picks the compression codec of node once, nil sends plain scp.
+func detectCodec(dialControl func() (*scpw.SCP, error), node *scpw.Node) (*scpw.Codec, error) {
+	if node.Compression == "" || node.Compression == scpw.CompressOff {
+		return nil, nil
+	}
+	control, err := dialControl()
+	if err != nil {
+		return nil, err
+	}
+	codec, err := control.DetectCodec(node.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		log.Printf("node:[%s] no codec available, compression disabled", node.Name)
+	}
+	return codec, nil
+}
+
+func initScpCli(ctx *cli.Context, node *scpw.Node, global *scpw.Limiter, p *scpw.Progress, r *report) error {
+	// control runs the hooks, creates the remote dirs of split trees and
+	// sizes GET sources, one connection dialed on first use
+	var control *scpw.SCP
+	dialControl := func() (*scpw.SCP, error) {
+		if control == nil {
+			ssh, err := dial(node)
+			if err != nil {
+				return nil, err
+			}
+			control = scpw.NewSCP(ssh, ctx.Bool("keep-time"))
+		}
+		return control, nil
+	}
+	defer func() {
+		if control != nil {
+			control.Close()
+		}
+	}()
+	var hookCli *ssh.Client
+	if node.HasRemoteHooks() {
+		c, err := dialControl()
+		if err != nil {
+			return err
+		}
+		hookCli = c.Client
+	}
+	if err := node.RunPreHooks(hookCli); err != nil {
+		return err
+	}
+	err := transfer(ctx, node, dialControl, global, p, r)
+	if e := node.RunPostHooks(hookCli, err); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// job is one unit of the worker pool, a whole lr-map entry or one file of a split tree.
+type job struct {
+	local, remote string
+	ctx           scpw.Context
+}
+
+func transfer(ctx *cli.Context, node *scpw.Node, dialControl func() (*scpw.SCP, error), global *scpw.Limiter, p *scpw.Progress, r *report) error {
+	if node.Typ == scpw.PUT && node.RemoteBackup {
+		if err := backupRemote(dialControl, node); err != nil {
+			return err
+		}
+	}
+	codec, err := detectCodec(dialControl, node)
+	if err != nil {
+		return err
+	}
+	tracker := p.NewTracker(node.Name)
 	keepTime := ctx.Bool("keep-time")
+	limiters := []*scpw.Limiter{scpw.NewLimiter(node.BWLimit), global}
 	wg := sync.WaitGroup{}
-	todo := make(chan scpw.LRMap, 5)
-	for i := 0; i < threads; i++ {
+	errMu := sync.Mutex{}
+	var firstErr error
+	fail := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var jobs []job
+	var trees []*scpw.Tree
+	for _, lr := range node.LRMap {
+		local, remote := lr.Local, lr.Remote
+		backup, err := node.BackupOf(lr)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		scpwCtx := scpw.Context{Ctx: ctx.Context, Verify: node.VerifyOf(lr), Atomic: node.AtomicOf(lr), Backup: backup, Limiters: limiters, Codec: codec, Chunks: node.ChunksOf(lr), Tracker: tracker}
+		if node.Typ == scpw.PUT && node.SplitOf(lr) && !scpwCtx.Atomic {
+			tree, err := splitTree(dialControl, lr)
+			if err != nil {
+				fail(fmt.Errorf("local:[%s] remote:[%s] failed! e: %v", local, remote, err))
+				continue
+			}
+			if tree != nil {
+				trees = append(trees, tree)
+				tracker.Add(int64(len(tree.Files)), tree.Size)
+				for _, file := range tree.Files {
+					jobs = append(jobs, job{local: file.Local, remote: file.Remote, ctx: scpwCtx})
+				}
+				continue
+			}
+		}
+		if files, size, err := total(dialControl, node.Typ, lr); err != nil {
+			log.Printf("size of local:[%s] remote:[%s] unknown, e: %v", local, remote, err)
+		} else {
+			tracker.Add(files, size)
+		}
+		jobs = append(jobs, job{local: local, remote: remote, ctx: scpwCtx})
+	}
+
+	r.total = len(jobs)
+	todo := make(chan job, len(jobs))
+	for _, j := range jobs {
+		todo <- j
+	}
+	close(todo)
+	// no idle connections for fewer jobs
+	workers := ctx.Int("jobs")
+	if node.Concurrency > 0 {
+		workers = node.Concurrency
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < scpw.MinInt(workers, len(jobs)); i++ {
 		wg.Add(1)
 		go func() {
-			ssh, err := scpw.NewSSH(node)
+			defer wg.Done()
+			ssh, err := dial(node)
 			if err != nil {
-				panic(err)
+				fail(err)
+				return
 			}
 			scpwCli := scpw.NewSCP(ssh, keepTime)
-			defer func() {
-				ssh.Close()
-				wg.Done()
-			}()
-			for lr := range todo {
-				local, remote := lr.Local, lr.Remote
-				scpwCtx := scpw.Context{Ctx: ctx.Context, Bar: p.NewInfiniteByesBar(local)}
-				err = scpwCli.SwitchScpwFunc(scpwCtx, local, remote, node.Typ)
-				scpwCtx.Bar.SetTotal(-1, true)
+			defer ssh.Close()
+			for j := range todo {
+				if err = ctx.Context.Err(); err == nil {
+					err = scpwCli.SwitchScpwFunc(j.ctx, j.local, j.remote, node.Typ)
+				}
+				errMu.Lock()
+				if err == nil {
+					r.completed = append(r.completed, fmt.Sprintf("local:[%s] remote:[%s]", j.local, j.remote))
+				} else if ctx.Context.Err() != nil {
+					r.cancelled++
+				}
+				errMu.Unlock()
 				if err != nil {
-					panic(err)
+					fail(fmt.Errorf("local:[%s] remote:[%s] failed! e: %v", j.local, j.remote, err))
 				}
 			}
 		}()
 	}
-	for _, lr := range node.LRMap {
-		todo <- lr
-	}
-	close(todo)
 	wg.Wait()
-	p.Wait()
-	return nil
+	tracker.Done()
+	if ctx.Context.Err() != nil {
+		return ctx.Context.Err()
+	}
+	for _, tree := range trees {
+		// the trees were planned on control, it is dialed already
+		control, err := dialControl()
+		if err == nil {
+			err = control.FinishTree(tree)
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+	return firstErr
+}
+
+// splitTree plans lr as per-file jobs and creates its remote dirs, nil when lr is a file.
+func splitTree(dialControl func() (*scpw.SCP, error), lr scpw.LRMap) (*scpw.Tree, error) {
+	tree, err := scpw.SplitTree(lr.Local, lr.Remote)
+	if err != nil || tree == nil {
+		return nil, err
+	}
+	control, err := dialControl()
+	if err != nil {
+		return nil, err
+	}
+	return tree, control.MkdirTree(tree)
+}
+
+// total sizes the source of lr, the local walk for PUT and the remote tree for GET.
+func total(dialControl func() (*scpw.SCP, error), typ scpw.SCPWType, lr scpw.LRMap) (int64, int64, error) {
+	if typ == scpw.PUT {
+		return scpw.LocalTotal(lr.Local)
+	}
+	control, err := dialControl()
+	if err != nil {
+		return 0, 0, err
+	}
+	return control.RemoteTotal(lr.Remote)
 }
@@ -0,0 +1,385 @@
+package scpw
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type CompressMode = string
+
+const (
+	CompressOff  CompressMode = "false"
+	CompressOn   CompressMode = "true"
+	CompressAuto CompressMode = "auto"
+)
+
+// Codec compresses the data stream of a transfer. golang.org/x/crypto/ssh does
+// not implement zlib@openssh.com, so instead of SSH-level compression the
+// content is piped as a tar stream through gzip or zstd on both ends.
+type Codec struct {
+	Name             string
+	remoteCompress   string
+	remoteDecompress string
+}
+
+// codecs in order of preference
+var codecs = []Codec{
+	{Name: "zstd", remoteCompress: "zstd -q -c", remoteDecompress: "zstd -q -dc"},
+	{Name: "gzip", remoteCompress: "gzip -c", remoteDecompress: "gzip -dc"},
+}
+
+func (c *Codec) localAvailable() bool {
+	if c.Name == "gzip" {
+		return true
+	}
+	_, err := exec.LookPath(c.Name)
+	return err == nil
+}
+
+// DetectCodec picks the first codec available on both ends. `auto` falls back
+// to plain scp when there is none, `true` fails.
+func (scp *SCP) DetectCodec(mode CompressMode) (*Codec, error) {
+	switch mode {
+	case "", CompressOff:
+		return nil, nil
+	case CompressOn, CompressAuto:
+	default:
+		return nil, fmt.Errorf("invalid compression:[%s]", mode)
+	}
+	for i := range codecs {
+		c := codecs[i]
+		if !c.localAvailable() {
+			continue
+		}
+		if _, err := scp.Output(fmt.Sprintf("command -v %s && command -v tar", c.Name)); err == nil {
+			return &c, nil
+		}
+	}
+	if mode == CompressOn {
+		return nil, fmt.Errorf("compression needs tar and one of zstd, gzip on both ends")
+	}
+	return nil, nil
+}
+
+type cmdWriteCloser struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdWriteCloser) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return c.cmd.Wait()
+}
+
+type cmdReadCloser struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReadCloser) Close() error {
+	c.ReadCloser.Close()
+	return c.cmd.Wait()
+}
+
+func (c *Codec) compressor(w io.Writer) (io.WriteCloser, error) {
+	if c.Name == "gzip" {
+		return gzip.NewWriter(w), nil
+	}
+	cmd := exec.Command(c.Name, "-q", "-c")
+	cmd.Stdout = w
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdWriteCloser{WriteCloser: in, cmd: cmd}, nil
+}
+
+func (c *Codec) decompressor(r io.Reader) (io.ReadCloser, error) {
+	if c.Name == "gzip" {
+		return gzip.NewReader(r)
+	}
+	cmd := exec.Command(c.Name, "-q", "-dc")
+	cmd.Stdin = r
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReadCloser{ReadCloser: out, cmd: cmd}, nil
+}
+
+// putCompressed sends srcPath as a compressed tar stream extracted into dstDir,
+// the root entry is renamed to name.
+func (scp *SCP) putCompressed(ctx Context, srcPath, dstDir, name string) error {
+	session, stop, err := scp.newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer stop()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &strings.Builder{}
+	session.Stderr = stderr
+	if err = session.Start(fmt.Sprintf("%s | tar -xpf - -C %q", ctx.Codec.remoteDecompress, dstDir)); err != nil {
+		return err
+	}
+
+	// the limiters throttle the compressed bytes on the wire
+	pr, pw := io.Pipe()
+	copied := make(chan error, 1)
+	go func() {
+		_, e := io.Copy(stdin, ctx.limit(pr))
+		pr.CloseWithError(e)
+		stdin.Close()
+		copied <- e
+	}()
+
+	var sums []checksum
+	err = func() error {
+		zw, err := ctx.Codec.compressor(pw)
+		if err != nil {
+			return err
+		}
+		tw := tar.NewWriter(zw)
+		if sums, err = scp.writeTar(ctx, tw, srcPath, name, dstDir); err != nil {
+			return err
+		}
+		if err = tw.Close(); err != nil {
+			return err
+		}
+		return zw.Close()
+	}()
+	pw.CloseWithError(err)
+	if e := <-copied; err == nil {
+		err = e
+	}
+	if e := session.Wait(); err == nil && e != nil {
+		err = fmt.Errorf("remote tar failed! e: %v %s", e, stderr.String())
+	}
+	if err != nil {
+		return err
+	}
+	return scp.verify(ctx.Verify, sums)
+}
+
+// putTarget resolves the dir and the name a file upload to dstPath lands at,
+// an existing remote dir gets the file inside it like scp does.
+func (scp *SCP) putTarget(srcPath, dstPath string) (string, string, error) {
+	dstPath = filepath.Clean(dstPath)
+	out, err := scp.Output(fmt.Sprintf("[ ! -d %q ] || echo dir", dstPath))
+	if err != nil {
+		return "", "", fmt.Errorf("stat remote:[%s] failed! e: %v", dstPath, err)
+	}
+	if strings.TrimSpace(string(out)) == "dir" {
+		return dstPath, filepath.Base(srcPath), nil
+	}
+	return filepath.Dir(dstPath), filepath.Base(dstPath), nil
+}
+
+// writeTar writes the srcPath tree into tw, entries are named after name.
+func (scp *SCP) writeTar(ctx Context, tw *tar.Writer, srcPath, name, dstDir string) ([]checksum, error) {
+	var sums []checksum
+	var walk func(local, entry string) error
+	walk = func(local, entry string) error {
+		stat, err := os.Stat(local)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(stat, "")
+		if err != nil {
+			return err
+		}
+		header.Name = entry
+		if stat.IsDir() {
+			header.Name += "/"
+		}
+		// tar rounds to the nearest second, scp truncates
+		header.ModTime = stat.ModTime().Truncate(time.Second)
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+		if !scp.KeepTime {
+			header.ModTime = time.Now().Truncate(time.Second)
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if stat.IsDir() {
+			child, err := StatDirChild(local)
+			if err != nil {
+				return err
+			}
+			for _, c := range child {
+				if err = walk(filepath.Join(local, c.Name()), path.Join(entry, c.Name())); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		h, err := ctx.newHash()
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err = ctx.copy(stat.Name(), tw, hashReader(file, h), stat.Size()); err != nil {
+			return err
+		}
+		if h != nil {
+			sums = append(sums, checksum{remote: filepath.Join(dstDir, filepath.FromSlash(entry)), sum: sumOf(h)})
+		}
+		return nil
+	}
+	return sums, walk(srcPath, name)
+}
+
+// getCompressed receives remotePath as a compressed tar stream into localDir,
+// the root entry is renamed to name. wantDir checks the type of the root entry.
+func (scp *SCP) getCompressed(ctx Context, remotePath, localDir, name string, wantDir bool) error {
+	remotePath = filepath.Clean(remotePath)
+	session, stop, err := scp.newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer stop()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &strings.Builder{}
+	session.Stderr = stderr
+	// -h follows symlinks, as scp does
+	cmd := fmt.Sprintf("tar -chf - -C %q %q | %s", filepath.Dir(remotePath), filepath.Base(remotePath), ctx.Codec.remoteCompress)
+	if err = session.Start(cmd); err != nil {
+		return err
+	}
+	zr, err := ctx.Codec.decompressor(ctx.limit(stdout))
+	if err != nil {
+		return err
+	}
+	sums, err := scp.readTar(ctx, tar.NewReader(zr), remotePath, localDir, name, wantDir)
+	if err == nil {
+		// consume the tar padding so the remote pipeline exits cleanly
+		_, err = io.Copy(io.Discard, zr)
+	}
+	if e := zr.Close(); err == nil && e != nil {
+		err = e
+	}
+	if e := session.Wait(); err == nil && e != nil {
+		err = e
+	}
+	if err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%v %s", err, stderr.String())
+		}
+		return err
+	}
+	return scp.verify(ctx.Verify, sums)
+}
+
+func (scp *SCP) readTar(ctx Context, tr *tar.Reader, remotePath, localDir, name string, wantDir bool) ([]checksum, error) {
+	var sums []checksum
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+	root := filepath.Base(remotePath)
+	found := false
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return sums, err
+		}
+		entry := path.Clean(header.Name)
+		if entry != root && !strings.HasPrefix(entry, root+"/") {
+			return sums, fmt.Errorf("invalid tar entry:[%s]", header.Name)
+		}
+		if !found {
+			found = true
+			if isDir := header.Typeflag == tar.TypeDir; isDir != wantDir {
+				if isDir {
+					return sums, fmt.Errorf("remote:[%s] is dir", remotePath)
+				}
+				return sums, fmt.Errorf("remote:[%s] is not dir", remotePath)
+			}
+		}
+		local := filepath.Join(localDir, name, filepath.FromSlash(strings.TrimPrefix(entry, root)))
+		mode := header.FileInfo().Mode().Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(local, mode); err != nil {
+				return sums, err
+			}
+			if err = os.Chmod(local, mode); err != nil {
+				return sums, err
+			}
+			dirs = append(dirs, dirTime{path: local, mtime: header.ModTime})
+		case tar.TypeReg:
+			h, err := ctx.newHash()
+			if err != nil {
+				return sums, err
+			}
+			file, err := os.OpenFile(local, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return sums, err
+			}
+			err = ctx.copy(path.Base(entry), hashWriter(file, h), tr, header.Size)
+			file.Close()
+			if err != nil {
+				os.Remove(local)
+				return sums, err
+			}
+			if err = os.Chmod(local, mode); err != nil {
+				return sums, err
+			}
+			if scp.KeepTime {
+				if err = os.Chtimes(local, header.ModTime, header.ModTime); err != nil {
+					return sums, err
+				}
+			}
+			if h != nil {
+				sums = append(sums, checksum{remote: filepath.Join(filepath.Dir(remotePath), filepath.FromSlash(entry)), sum: sumOf(h)})
+			}
+		default:
+			// links are followed by the remote tar, a fifo or device has no content to copy
+			return sums, fmt.Errorf("remote:[%s] is not a regular file or dir", filepath.Join(filepath.Dir(remotePath), filepath.FromSlash(entry)))
+		}
+	}
+	if !found {
+		return sums, fmt.Errorf("remote:[%s] not found", remotePath)
+	}
+	if scp.KeepTime {
+		// creating children changes the mtime of a dir, restore deepest first
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime); err != nil {
+				return sums, err
+			}
+		}
+	}
+	return sums, nil
+}
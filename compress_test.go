@@ -0,0 +1,107 @@
+package scpw
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectCodec(t *testing.T) {
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	codec, err := scpwCli.DetectCodec(CompressOff)
+	assert.Nil(t, err)
+	assert.Nil(t, codec)
+
+	codec, err = scpwCli.DetectCodec(CompressAuto)
+	assert.Nil(t, err)
+	require.NotNil(t, codec)
+
+	_, err = scpwCli.DetectCodec("zip")
+	assert.NotNil(t, err)
+}
+
+func TestCompressedTransfer(t *testing.T) {
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	for i := range codecs {
+		codec := codecs[i]
+		if !codec.localAvailable() {
+			continue
+		}
+		t.Run(codec.Name, func(t *testing.T) {
+			p := NewProgress()
+			ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar(""), Verify: SHA256, Codec: &codec}
+
+			local, remote := RandName(tmpDir), RandName(tmpDir)
+			require.Nil(t, writeFile(local))
+			require.Nil(t, scpwCli.Put(ctx, local, remote))
+			assertSameFile(t, local, remote)
+
+			// a dir target gets the file inside it
+			into := RandName(tmpDir)
+			require.Nil(t, mkdir(into))
+			require.Nil(t, scpwCli.Put(ctx, local, into))
+			assertSameFile(t, local, filepath.Join(into, filepath.Base(local)))
+
+			back := RandName(tmpDir)
+			require.Nil(t, scpwCli.Get(ctx, back, remote))
+			assertSameFile(t, remote, back)
+
+			remoteDir := RandName(tmpDir)
+			require.Nil(t, mkdir(remoteDir))
+			require.Nil(t, scpwCli.PutAll(ctx, baseLocalDir, remoteDir))
+			assertSameFile(t, filepath.Join(baseLocalDir, "child", "b"), filepath.Join(remoteDir, filepath.Base(baseLocalDir), "child", "b"))
+
+			localDir := RandName(tmpDir)
+			require.Nil(t, mkdir(localDir))
+			require.Nil(t, scpwCli.GetAll(ctx, localDir, baseRemoteDir))
+			assertSameFile(t, filepath.Join(baseRemoteDir, "c"), filepath.Join(localDir, filepath.Base(baseRemoteDir), "c"))
+			expected, err := os.Stat(baseRemoteDir)
+			require.Nil(t, err)
+			actual, err := os.Stat(filepath.Join(localDir, filepath.Base(baseRemoteDir)))
+			require.Nil(t, err)
+			assert.Equal(t, expected.ModTime().Unix(), actual.ModTime().Unix())
+
+			// the root type is checked
+			assert.NotNil(t, scpwCli.Get(ctx, RandName(tmpDir), baseRemoteDir))
+			assert.NotNil(t, scpwCli.GetAll(ctx, localDir, remote))
+			assert.NotNil(t, scpwCli.Get(ctx, RandName(tmpDir), filepath.Join(tmpDir, "not-exist")))
+			_, err = os.Stat(filepath.Join(localDir, filepath.Base(remote)))
+			assert.True(t, os.IsNotExist(err))
+
+			// a link is received as what it points to
+			linkDir := RandName(tmpDir)
+			require.Nil(t, mkdir(linkDir))
+			require.Nil(t, os.Symlink(remote, filepath.Join(linkDir, "link")))
+			require.Nil(t, scpwCli.GetAll(ctx, localDir, linkDir))
+			link, err := os.Lstat(filepath.Join(localDir, filepath.Base(linkDir), "link"))
+			require.Nil(t, err)
+			assert.True(t, link.Mode().IsRegular())
+			assertSameFile(t, remote, filepath.Join(localDir, filepath.Base(linkDir), "link"))
+		})
+	}
+}
+
+func TestReadTarSpecialEntry(t *testing.T) {
+	b := &bytes.Buffer{}
+	tw := tar.NewWriter(b)
+	require.Nil(t, tw.WriteHeader(&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.Nil(t, tw.WriteHeader(&tar.Header{Name: "d/fifo", Typeflag: tar.TypeFifo, Mode: 0644}))
+	require.Nil(t, tw.Close())
+
+	scpwCli := NewSCP(nil, true)
+	_, err := scpwCli.readTar(Context{Ctx: context.Background()}, tar.NewReader(b), "/srv/d", t.TempDir(), "d", true)
+	assert.EqualError(t, err, "remote:["+filepath.Join("/srv", "d", "fifo")+"] is not a regular file or dir")
+}
@@ -2,10 +2,13 @@ package scpw
 
 import (
 	"fmt"
-	"gopkg.in/yaml.v2"
+	"github.com/kevinburke/ssh_config"
+	"gopkg.in/yaml.v3"
+	"io"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
 )
 
 type SCPWType = string
@@ -16,48 +19,365 @@ const (
 )
 
 type Node struct {
-	Name     string   `yaml:"name"`
-	Host     string   `yaml:"host"`
-	User     string   `yaml:"user"`
-	Port     string   `yaml:"port"`
-	KeyPath  string   `yaml:"keypath"`
-	Password string   `yaml:"password"`
-	Children []*Node  `yaml:"children"`
-	LRMap    []LRMap  `yaml:"lr-map"`
-	Typ      SCPWType `yaml:"type"`
+	Name     string `yaml:"name,omitempty" json:"name,omitempty" toml:"name,omitempty"`
+	Host     string `yaml:"host,omitempty" json:"host,omitempty" toml:"host,omitempty"`
+	User     string `yaml:"user,omitempty" json:"user,omitempty" toml:"user,omitempty"`
+	Port     string `yaml:"port,omitempty" json:"port,omitempty" toml:"port,omitempty"`
+	KeyPath  string `yaml:"keypath,omitempty" json:"keypath,omitempty" toml:"keypath,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty" toml:"password,omitempty"`
+	// PasswordEnv, PasswordCmd and PasswordSecret keep the password out of
+	// the config, it is resolved when the server asks for it
+	PasswordEnv        string     `yaml:"password-env,omitempty" json:"password-env,omitempty" toml:"password-env,omitempty"`
+	PasswordCmd        string     `yaml:"password-cmd,omitempty" json:"password-cmd,omitempty" toml:"password-cmd,omitempty"`
+	PasswordSecret     string     `yaml:"password-secret,omitempty" json:"password-secret,omitempty" toml:"password-secret,omitempty"`
+	Children           []*Node    `yaml:"children,omitempty" json:"children,omitempty" toml:"children,omitempty"`
+	LRMap              []LRMap    `yaml:"lr-map,omitempty" json:"lr-map,omitempty" toml:"lr-map,omitempty"`
+	Typ                SCPWType   `yaml:"type,omitempty" json:"type,omitempty" toml:"type,omitempty"`
+	Verify             VerifyType `yaml:"verify,omitempty" json:"verify,omitempty" toml:"verify,omitempty"`
+	Atomic             bool       `yaml:"atomic,omitempty" json:"atomic,omitempty" toml:"atomic,omitempty"`
+	Backup             string     `yaml:"backup,omitempty" json:"backup,omitempty" toml:"backup,omitempty"`
+	BackupDir          string     `yaml:"backup-dir,omitempty" json:"backup-dir,omitempty" toml:"backup-dir,omitempty"`
+	RemoteBackup       bool       `yaml:"remote-backup,omitempty" json:"remote-backup,omitempty" toml:"remote-backup,omitempty"`
+	RemoteBackupDir    string     `yaml:"remote-backup-dir,omitempty" json:"remote-backup-dir,omitempty" toml:"remote-backup-dir,omitempty"`
+	PreHooks           []string   `yaml:"pre-hooks,omitempty" json:"pre-hooks,omitempty" toml:"pre-hooks,omitempty"`
+	PostHooks          []string   `yaml:"post-hooks,omitempty" json:"post-hooks,omitempty" toml:"post-hooks,omitempty"`
+	LocalPreHooks      []string   `yaml:"local-pre-hooks,omitempty" json:"local-pre-hooks,omitempty" toml:"local-pre-hooks,omitempty"`
+	LocalPostHooks     []string   `yaml:"local-post-hooks,omitempty" json:"local-post-hooks,omitempty" toml:"local-post-hooks,omitempty"`
+	PostHooksOnFailure HookPolicy `yaml:"post-hooks-on-failure,omitempty" json:"post-hooks-on-failure,omitempty" toml:"post-hooks-on-failure,omitempty"`
+	// BWLimit caps the bandwidth of all transfers of the node in KB/s
+	BWLimit int64 `yaml:"bwlimit,omitempty" json:"bwlimit,omitempty" toml:"bwlimit,omitzero"`
+	// Compression is true, false or auto
+	Compression CompressMode `yaml:"compression,omitempty" json:"compression,omitempty" toml:"compression,omitempty"`
+	// Split uploads the files of a directory lr-map entry in parallel
+	Split bool `yaml:"split,omitempty" json:"split,omitempty" toml:"split,omitempty"`
+	// Chunks uploads files of 64MB and more as that many concurrent ranges
+	Chunks int `yaml:"chunks,omitempty" json:"chunks,omitempty" toml:"chunks,omitzero"`
+	// Concurrency is the number of connections of the node, overrides --jobs
+	Concurrency int `yaml:"concurrency,omitempty" json:"concurrency,omitempty" toml:"concurrency,omitzero"`
+	// Vars are used by the templates of lr-map paths as {{.Vars.name}}
+	Vars map[string]string `yaml:"vars,omitempty" json:"vars,omitempty" toml:"vars,omitempty"`
 }
 
 type LRMap struct {
-	Local  string `yaml:"local"`
-	Remote string `yaml:"remote"`
+	Local  string     `yaml:"local,omitempty" json:"local,omitempty" toml:"local,omitempty"`
+	Remote string     `yaml:"remote,omitempty" json:"remote,omitempty" toml:"remote,omitempty"`
+	Verify VerifyType `yaml:"verify,omitempty" json:"verify,omitempty" toml:"verify,omitempty"`
+	// Atomic overrides the atomic of the node when set, false turns it off for the entry
+	Atomic    *bool  `yaml:"atomic,omitempty" json:"atomic,omitempty" toml:"atomic,omitempty"`
+	Backup    string `yaml:"backup,omitempty" json:"backup,omitempty" toml:"backup,omitempty"`
+	BackupDir string `yaml:"backup-dir,omitempty" json:"backup-dir,omitempty" toml:"backup-dir,omitempty"`
+	Split     bool   `yaml:"split,omitempty" json:"split,omitempty" toml:"split,omitempty"`
+	Chunks    int    `yaml:"chunks,omitempty" json:"chunks,omitempty" toml:"chunks,omitzero"`
+}
+
+// VerifyOf returns the checksum algorithm for lr, an lr-map entry overrides the node.
+func (n *Node) VerifyOf(lr LRMap) VerifyType {
+	if lr.Verify != "" {
+		return lr.Verify
+	}
+	return n.Verify
+}
+
+// AtomicOf reports whether lr is uploaded to a temp name and renamed into place, an lr-map entry overrides the node.
+func (n *Node) AtomicOf(lr LRMap) bool {
+	if lr.Atomic != nil {
+		return *lr.Atomic
+	}
+	return n.Atomic
+}
+
+// SplitOf reports whether the files of a directory lr are distributed across the workers.
+func (n *Node) SplitOf(lr LRMap) bool {
+	return n.Split || lr.Split
+}
+
+// ChunksOf returns the number of ranges a large file of lr is split into, an lr-map entry overrides the node.
+func (n *Node) ChunksOf(lr LRMap) int {
+	if lr.Chunks != 0 {
+		return lr.Chunks
+	}
+	return n.Chunks
+}
+
+// BackupOf returns the backup policy for local files replaced by lr, an lr-map entry overrides the node.
+func (n *Node) BackupOf(lr LRMap) (Backup, error) {
+	policy, dir := n.Backup, n.BackupDir
+	if lr.Backup != "" {
+		policy = lr.Backup
+	}
+	if lr.BackupDir != "" {
+		dir = lr.BackupDir
+	}
+	return ParseBackup(policy, dir)
+}
+
+// Config is a loaded config and the files it was read from.
+type Config struct {
+	Paths []string
+	Nodes []*Node
+}
+
+// ConfigNames are the default configs, searched in order.
+var ConfigNames = []string{".scpw", ".scpw.yml", ".scpw.yaml", ".scpw.json", ".scpw.toml", ".scpw.yml.enc", ".scpw.yaml.enc", ".scpw.json.enc", ".scpw.toml.enc"}
+
+// ReadConfig loads and validates the files of paths, a node of a later file
+// overrides the node of the same name of an earlier one, see ParseConfigFiles.
+// Without paths the first config found by LoadConfigFile is loaded together
+// with the files of ~/.scpw.d. Children inherit the settings of their parents.
+func ReadConfig(paths ...string) (*Config, error) {
+	var files []ConfigFile
+	if len(paths) == 0 {
+		f, err := defaultConfig()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	for _, path := range paths {
+		b, err := ReadConfigData(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ConfigFile{Path: path, Data: b})
+	}
+	nodes, read, own, err := parseConfigFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	inherit(nodes, nil, own)
+	resolveDefaults(nodes)
+	return &Config{Paths: read, Nodes: nodes}, nil
+}
+
+// defaultConfig is the first config found by LoadConfigFile including the
+// files of ConfigDir, either may be missing.
+func defaultConfig() (ConfigFile, error) {
+	u, err := user.Current()
+	if err != nil {
+		return ConfigFile{}, err
+	}
+	includes, err := ConfigDirFiles(filepath.Join(u.HomeDir, ConfigDir))
+	if err != nil {
+		return ConfigFile{}, err
+	}
+	path, b, err := LoadConfigFile(ConfigNames...)
+	if err != nil {
+		if len(includes) == 0 {
+			return ConfigFile{}, err
+		}
+		path = filepath.Join(u.HomeDir, ConfigDir)
+	}
+	return ConfigFile{Path: path, Data: b, Includes: includes}, nil
 }
 
 func LoadConfig() ([]*Node, error) {
-	b, err := LoadConfigBytes(".scpw", ".scpw.yml", ".scpw.yaml")
+	config, err := ReadConfig()
 	if err != nil {
 		return nil, err
 	}
-	var config []*Node
-	err = yaml.Unmarshal(b, &config)
-	return config, err
+	return config.Nodes, nil
+}
+
+// notInherited are the Node fields a child never takes from its parent.
+var notInherited = map[string]bool{"Name": true, "Children": true, "LRMap": true}
+
+// authFields are inherited together, a child with a keypath must not log in
+// with the password of its parent.
+var authFields = map[string]bool{"KeyPath": true, "Password": true, "PasswordEnv": true, "PasswordCmd": true, "PasswordSecret": true}
+
+// inherit fills the empty fields of nodes from parent, top down so a
+// grandchild sees what its parent inherited. own are the keys a node sets
+// itself, see ownKeys, a false or 0 it sets is not overridden.
+func inherit(nodes []*Node, parent *Node, own map[*Node]map[string]bool) {
+	for _, n := range nodes {
+		if parent != nil {
+			dst, src := reflect.ValueOf(n).Elem(), reflect.ValueOf(parent).Elem()
+			ownAuth := false
+			for name := range authFields {
+				ownAuth = ownAuth || !dst.FieldByName(name).IsZero()
+			}
+			for i := 0; i < dst.NumField(); i++ {
+				d, s := dst.Field(i), src.Field(i)
+				field := dst.Type().Field(i)
+				name := field.Name
+				switch {
+				case notInherited[name], ownAuth && authFields[name]:
+				case d.IsZero() && !own[n][yamlKey(field)]:
+					d.Set(s)
+				case d.Kind() == reflect.Map:
+					// the keys of a map are inherited one by one
+					for _, k := range s.MapKeys() {
+						if !d.MapIndex(k).IsValid() {
+							d.SetMapIndex(k, s.MapIndex(k))
+						}
+					}
+				}
+			}
+		}
+		inherit(n.Children, n, own)
+	}
+}
+
+// DefaultPort is the port of a node without one.
+const DefaultPort = "22"
+
+// sshConfigUser returns the User ~/.ssh/config sets for host, empty when none.
+var sshConfigUser = func(host string) string {
+	return ssh_config.Get(host, "User")
+}
+
+// resolveDefaults splits the port off the host of nodes and fills the port
+// and user they leave empty, see resolveLogin. It runs after inherit, the
+// settings of a group come first.
+func resolveDefaults(nodes []*Node) {
+	for _, n := range nodes {
+		resolveDefaults(n.Children)
+		if n.Host != "" {
+			n.Host, n.Port, n.User = resolveLogin(n.Host, n.Port, n.User)
+		}
+	}
+}
+
+// resolveLogin splits the port off host and fills an empty port and user,
+// the user from the ssh config or the current user.
+func resolveLogin(host, port, name string) (string, string, string) {
+	// the validator rejects an invalid host
+	if h, p, err := SplitHost(host); err == nil {
+		host = h
+		if p != "" {
+			port = p
+		}
+	}
+	if port == "" {
+		port = DefaultPort
+	}
+	if name == "" {
+		name = sshConfigUser(host)
+	}
+	if name == "" {
+		if u, err := user.Current(); err == nil {
+			name = loginName(u)
+		}
+	}
+	return host, port, name
+}
+
+// FindNode searches nodes and their children by name.
+func FindNode(nodes []*Node, name string) *Node {
+	for _, node := range nodes {
+		if node.Name == name {
+			return node
+		}
+		if child := FindNode(node.Children, name); child != nil {
+			return child
+		}
+	}
+	return nil
+}
+
+// NodeChoice is a node of the picker, Path names it after its groups.
+type NodeChoice struct {
+	*Node
+	Path string
+}
+
+// NodeChoices lists nodes and their children depth first, so every node can
+// be picked.
+func NodeChoices(nodes []*Node) []NodeChoice {
+	var choices []NodeChoice
+	var walk func(nodes []*Node, parent string)
+	walk = func(nodes []*Node, parent string) {
+		for _, n := range nodes {
+			path := n.Name
+			if parent != "" {
+				path = parent + "/" + n.Name
+			}
+			choices = append(choices, NodeChoice{Node: n, Path: path})
+			walk(n.Children, path)
+		}
+	}
+	walk(nodes, "")
+	return choices
+}
+
+// Runnable returns the nodes picking n runs, n when it has an lr-map, else
+// the nodes of its children that have one, all at once.
+func (n *Node) Runnable() []*Node {
+	if len(n.LRMap) > 0 {
+		return []*Node{n}
+	}
+	var nodes []*Node
+	for _, child := range n.Children {
+		nodes = append(nodes, child.Runnable()...)
+	}
+	return nodes
+}
+
+// secretMask replaces the password of nodes printed by Masked.
+const secretMask = "******"
+
+// Masked returns a copy of nodes, children included, with the passwords masked.
+// Vars are printed in clear, the lr-map paths show their values anyway.
+func Masked(nodes []*Node) []*Node {
+	var masked []*Node
+	for _, n := range nodes {
+		c := *n
+		if c.Password != "" {
+			c.Password = secretMask
+		}
+		c.Children = Masked(n.Children)
+		masked = append(masked, &c)
+	}
+	return masked
+}
+
+// WriteConfig writes nodes as yaml, empty fields are omitted.
+func WriteConfig(w io.Writer, nodes []*Node) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(nodes); err != nil {
+		return err
+	}
+	return enc.Close()
 }
 
 func LoadConfigBytes(names ...string) ([]byte, error) {
+	_, b, err := LoadConfigFile(names...)
+	return b, err
+}
+
+// LoadConfigFile reads the first of names in the home dir, then relative to
+// the working dir, and returns the path it was read from. An encrypted config
+// is decrypted, see ReadConfigData.
+func LoadConfigFile(names ...string) (string, []byte, error) {
+	path, err := FindConfigFile(names...)
+	if err != nil {
+		return "", nil, err
+	}
+	b, err := ReadConfigData(path)
+	return path, b, err
+}
+
+// FindConfigFile returns the first of names that exists in the home dir, then
+// relative to the working dir.
+func FindConfigFile(names ...string) (string, error) {
 	u, err := user.Current()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	// homedir
 	for i := range names {
-		if sshw, e := os.ReadFile(filepath.Join(u.HomeDir, names[i])); e == nil {
-			return sshw, nil
+		path := filepath.Join(u.HomeDir, names[i])
+		if _, e := os.Stat(path); e == nil {
+			return path, nil
 		}
 	}
 	// relative
 	for i := range names {
-		if sshw, e := os.ReadFile(names[i]); e == nil {
-			return sshw, nil
+		if _, e := os.Stat(names[i]); e == nil {
+			path, _ := filepath.Abs(names[i])
+			return path, nil
 		}
 	}
-	return nil, fmt.Errorf("cannot find config from %s", u.HomeDir)
+	return "", fmt.Errorf("cannot find config from %s", u.HomeDir)
 }
@@ -2,10 +2,12 @@ package scpw
 
 import (
 	"github.com/stretchr/testify/assert"
-	"gopkg.in/yaml.v2"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -29,3 +31,162 @@ func TestLoadConfig(t *testing.T) {
 	_, err = LoadConfig()
 	assert.Nil(t, err)
 }
+
+func TestInherit(t *testing.T) {
+	nodes := []*Node{{
+		Name: "group", User: "root", Port: "2222", Typ: PUT, Atomic: true,
+		Children: []*Node{
+			{Name: "a", Host: "10.0.0.1", LRMap: []LRMap{{Local: "/tmp/a", Remote: "/tmp/b"}}},
+			{Name: "b", Host: "10.0.0.2", User: "app", Typ: GET, Children: []*Node{{Name: "c"}}},
+		},
+	}}
+	inherit(nodes, nil, nil)
+	a, b, c := nodes[0].Children[0], nodes[0].Children[1], nodes[0].Children[1].Children[0]
+	assert.Equal(t, "root", a.User)
+	assert.Equal(t, "2222", a.Port)
+	assert.Equal(t, PUT, a.Typ)
+	assert.True(t, a.Atomic)
+	assert.Equal(t, "app", b.User)
+	assert.Equal(t, GET, b.Typ)
+	// a grandchild inherits through its parent, names and lr-maps are never inherited
+	assert.Equal(t, "app", c.User)
+	assert.Equal(t, "10.0.0.2", c.Host)
+	assert.Equal(t, "2222", c.Port)
+	assert.Equal(t, "c", c.Name)
+	assert.Nil(t, c.LRMap)
+	assert.Nil(t, nodes[0].LRMap)
+}
+
+func TestInheritOptOut(t *testing.T) {
+	nodes, _, own, err := parseConfigFiles([]ConfigFile{{Path: "scpw.yml", Data: []byte(`
+- name: group
+  user: root
+  type: PUT
+  atomic: true
+  split: true
+  remote-backup: true
+  chunks: 4
+  children:
+  - { name: a, host: 10.0.0.1, atomic: false, split: false, remote-backup: false, chunks: 0, lr-map: [{ local: /a, remote: /a }] }
+  - { name: b, host: 10.0.0.2, lr-map: [{ local: /b, remote: /b }] }
+`)}})
+	require.Nil(t, err)
+	inherit(nodes, nil, own)
+	// a child setting false or 0 keeps it, one leaving the keys out inherits them
+	a, b := nodes[0].Children[0], nodes[0].Children[1]
+	assert.False(t, a.Atomic)
+	assert.False(t, a.Split)
+	assert.False(t, a.RemoteBackup)
+	assert.Equal(t, 0, a.Chunks)
+	assert.Equal(t, "root", a.User)
+	assert.True(t, b.Atomic)
+	assert.True(t, b.Split)
+	assert.True(t, b.RemoteBackup)
+	assert.Equal(t, 4, b.Chunks)
+}
+
+func TestNodeChoices(t *testing.T) {
+	lr := []LRMap{{Local: "/a", Remote: "/a"}}
+	nodes := []*Node{
+		{Name: "web", Children: []*Node{
+			{Name: "web1", LRMap: lr},
+			{Name: "eu", Children: []*Node{{Name: "web2", LRMap: lr}}},
+			{Name: "empty"},
+		}},
+		{Name: "db", LRMap: lr, Children: []*Node{{Name: "replica", LRMap: lr}}},
+	}
+	var paths []string
+	for _, c := range NodeChoices(nodes) {
+		paths = append(paths, c.Path)
+	}
+	assert.Equal(t, []string{"web", "web/web1", "web/eu", "web/eu/web2", "web/empty", "db", "db/replica"}, paths)
+
+	// a group runs its nodes, a node with an lr-map only itself
+	assert.Equal(t, []*Node{nodes[0].Children[0], nodes[0].Children[1].Children[0]}, nodes[0].Runnable())
+	assert.Equal(t, []*Node{nodes[1]}, nodes[1].Runnable())
+	assert.Empty(t, nodes[0].Children[2].Runnable())
+}
+
+func TestFindNode(t *testing.T) {
+	nodes := []*Node{{Name: "a", Children: []*Node{{Name: "b", Children: []*Node{{Name: "c"}}}}}, {Name: "d"}}
+	assert.Equal(t, "a", FindNode(nodes, "a").Name)
+	assert.Equal(t, "c", FindNode(nodes, "c").Name)
+	assert.Equal(t, "d", FindNode(nodes, "d").Name)
+	assert.Nil(t, FindNode(nodes, "e"))
+}
+
+func TestWriteConfig(t *testing.T) {
+	nodes := []*Node{{
+		Name: "group", Password: "123",
+		Children: []*Node{{Name: "a", Host: "10.0.0.1", Password: "456", Typ: PUT, LRMap: []LRMap{{Local: "/tmp/a", Remote: "/tmp/b"}}, Vars: map[string]string{"version": "1.2"}}},
+	}}
+	b := &strings.Builder{}
+	require.Nil(t, WriteConfig(b, Masked(nodes)))
+	assert.Equal(t, `- name: group
+  password: '******'
+  children:
+    - name: a
+      host: 10.0.0.1
+      password: '******'
+      lr-map:
+        - local: /tmp/a
+          remote: /tmp/b
+      type: PUT
+      vars:
+        version: "1.2"
+`, b.String())
+	// the config itself is not masked
+	assert.Equal(t, "123", nodes[0].Password)
+	assert.Equal(t, "456", nodes[0].Children[0].Password)
+}
+
+func TestReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	team, personal := filepath.Join(dir, "team.yml"), filepath.Join(dir, "personal.yml")
+	require.Nil(t, os.WriteFile(team, []byte(`
+- name: web
+  host: 10.0.0.1
+  user: deploy
+  password: "123"
+  type: PUT
+  lr-map: [{ local: /srv/app, remote: /srv/app }]
+`), 0600))
+	require.Nil(t, os.WriteFile(personal, []byte("- { name: web, user: me }\n"), 0600))
+
+	config, err := ReadConfig(team, personal)
+	require.Nil(t, err)
+	assert.Equal(t, []string{team, personal}, config.Paths)
+	require.Len(t, config.Nodes, 1)
+	assert.Equal(t, "me", config.Nodes[0].User)
+	assert.Equal(t, "123", config.Nodes[0].Password)
+
+	_, err = ReadConfig(team, filepath.Join(dir, "not-exist.yml"))
+	assert.NotNil(t, err)
+}
+
+func TestResolveDefaults(t *testing.T) {
+	defer func(f func(string) string) { sshConfigUser = f }(sshConfigUser)
+	sshConfigUser = func(host string) string {
+		if host == "10.0.0.2" {
+			return "ssh-user"
+		}
+		return ""
+	}
+	u, err := user.Current()
+	require.Nil(t, err)
+
+	nodes := []*Node{
+		{Name: "a", Host: "10.0.0.1"},
+		{Name: "b", Host: "10.0.0.2:2222", User: "root"},
+		{Name: "c", Host: "[::1]:2200"},
+		{Name: "d", Host: "::1", Port: "2201"},
+		{Name: "group", Children: []*Node{{Name: "e", Host: "10.0.0.2"}}},
+	}
+	resolveDefaults(nodes)
+	assert.Equal(t, [3]string{"10.0.0.1", "22", u.Username}, [3]string{nodes[0].Host, nodes[0].Port, nodes[0].User})
+	assert.Equal(t, [3]string{"10.0.0.2", "2222", "root"}, [3]string{nodes[1].Host, nodes[1].Port, nodes[1].User})
+	assert.Equal(t, [3]string{"::1", "2200", u.Username}, [3]string{nodes[2].Host, nodes[2].Port, nodes[2].User})
+	assert.Equal(t, "[::1]:2201", Addr(nodes[3].Host, nodes[3].Port))
+	assert.Equal(t, "", nodes[4].Port)
+	assert.Equal(t, "ssh-user", nodes[4].Children[0].User)
+}
@@ -0,0 +1,221 @@
+package scpw
+
+import (
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+// documentKeys are the keys of a config written as a document instead of a
+// bare node list.
+var documentKeys = []string{"defaults", "templates", "nodes", "include"}
+
+// addDefaults merges the defaults of a file into the ones read before, a
+// later file wins.
+func (l *loader) addDefaults(path string, defaults *yaml.Node) {
+	if !l.partial(path, defaults, "defaults") {
+		return
+	}
+	if i := indexOfKey(defaults, "extends"); i >= 0 {
+		l.v.errorf(defaults.Content[i], "extends is not allowed in defaults")
+		return
+	}
+	if l.defaults == nil {
+		l.defaults = defaults
+		return
+	}
+	overlay(l.defaults, defaults, false)
+}
+
+// addTemplates records the templates of a file by name, a later file
+// replaces a template.
+func (l *loader) addTemplates(path string, templates *yaml.Node) {
+	if templates.Kind != yaml.MappingNode {
+		l.v.errorf(templates, "templates expects a mapping of names to nodes, got %s", kindOf(templates))
+		return
+	}
+	for i := 0; i+1 < len(templates.Content); i += 2 {
+		name, t := templates.Content[i], templates.Content[i+1]
+		if l.partial(path, t, "template") {
+			l.templates[name.Value] = t
+		}
+	}
+}
+
+// partial checks the keys of defaults or a template, a part of a node that
+// is neither named nor has children.
+func (l *loader) partial(path string, n *yaml.Node, what string) bool {
+	fields := l.v.mapping(n, what, append(append([]string{}, nodeKeys...), "extends"))
+	if fields == nil {
+		return false
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if key := n.Content[i]; key.Value == "name" || key.Value == "children" {
+			l.v.errorf(key, "%s is not allowed in %s", key.Value, what)
+		}
+	}
+	var node Node
+	if err := n.Decode(&node); err != nil && l.typeErr == nil {
+		l.typeErr = yamlError(path, err)
+	}
+	return true
+}
+
+// extend merges into the nodes of seq the defaults and the templates they
+// extend, their own keys win over the templates, which win over the
+// defaults. Defaults apply to the top level nodes, whose children inherit
+// them, except lr-map which applies to every node without children.
+func (l *loader) extend(seq *yaml.Node, top bool) {
+	for _, n := range seq.Content {
+		if n.Kind != yaml.MappingNode {
+			continue
+		}
+		children := indexOfKey(n, "children")
+		base := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		if l.defaults != nil {
+			for i := 0; i+1 < len(l.defaults.Content); i += 2 {
+				key := l.defaults.Content[i].Value
+				if !partialKey(key) {
+					continue
+				}
+				if key == "lr-map" && children < 0 || key != "lr-map" && top {
+					base.Content = append(base.Content, l.v.copyNode(l.defaults.Content[i]), l.v.copyNode(l.defaults.Content[i+1]))
+				}
+			}
+		}
+		if i := indexOfKey(n, "extends"); i >= 0 {
+			for _, name := range l.extendsNames(n.Content[i+1]) {
+				if t := l.template(name, nil); t != nil {
+					overlay(base, l.v.copyNode(t), false)
+				}
+			}
+			n.Content = append(n.Content[:i:i], n.Content[i+2:]...)
+		}
+		if len(base.Content) > 0 {
+			overlay(base, n, false)
+			n.Content = base.Content
+		}
+		if i := indexOfKey(n, "children"); i >= 0 && n.Content[i+1].Kind == yaml.SequenceNode {
+			l.extend(n.Content[i+1], false)
+		}
+	}
+}
+
+// extendsNames returns the template names of an extends value, a name or a
+// list of names.
+func (l *loader) extendsNames(value *yaml.Node) []*yaml.Node {
+	names := []*yaml.Node{value}
+	if value.Kind == yaml.SequenceNode {
+		names = value.Content
+	}
+	for _, name := range names {
+		if name.Kind != yaml.ScalarNode || name.Value == "" {
+			l.v.errorf(name, "extends expects a template name or a list of names")
+			return nil
+		}
+	}
+	return names
+}
+
+// template returns the template named by name with the templates it extends
+// merged in. stack are the templates being resolved.
+func (l *loader) template(name *yaml.Node, stack []string) *yaml.Node {
+	if r, ok := l.resolved[name.Value]; ok {
+		return r
+	}
+	t, ok := l.templates[name.Value]
+	if !ok {
+		l.v.errorf(name, "unknown template %q", name.Value)
+		return nil
+	}
+	stack = append(stack, name.Value)
+	for i, s := range stack[:len(stack)-1] {
+		if s == name.Value {
+			l.v.errorf(name, "template cycle %s", strings.Join(stack[i:], " -> "))
+			return nil
+		}
+	}
+	r := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: t.Line, Column: t.Column}
+	l.v.files[r] = l.v.files[t]
+	if i := indexOfKey(t, "extends"); i >= 0 {
+		for _, parent := range l.extendsNames(t.Content[i+1]) {
+			if p := l.template(parent, stack); p != nil {
+				overlay(r, l.v.copyNode(p), false)
+			}
+		}
+	}
+	overlay(r, t, true)
+	l.resolved[name.Value] = r
+	return r
+}
+
+// overlay sets the keys of the mapping over on base. The entries of an
+// lr-map are merged by local, an entry of over overlays the one of base with
+// the same local and the others are appended, vars are merged by key and
+// every other value replaces the one of base. partial skips the keys a
+// template may not set, reported already.
+func overlay(base, over *yaml.Node, partial bool) {
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		key, value := over.Content[i], over.Content[i+1]
+		if partial && !partialKey(key.Value) {
+			continue
+		}
+		j := indexOfKey(base, key.Value)
+		switch {
+		case j < 0:
+			base.Content = append(base.Content, key, value)
+		case key.Value == "lr-map" && base.Content[j+1].Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+			overlayLRMap(base.Content[j+1], value)
+		case key.Value == "vars" && base.Content[j+1].Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			overlay(base.Content[j+1], value, false)
+		default:
+			base.Content[j], base.Content[j+1] = key, value
+		}
+	}
+}
+
+// partialKey reports whether defaults and templates may set key.
+func partialKey(key string) bool {
+	return key != "name" && key != "children" && contains(nodeKeys, key)
+}
+
+// overlayLRMap merges the lr-map entries of over into base by local.
+func overlayLRMap(base, over *yaml.Node) {
+	for _, lr := range over.Content {
+		local := scalarOf(lr, "local")
+		merged := false
+		for _, b := range base.Content {
+			if local != "" && scalarOf(b, "local") == local {
+				overlay(b, lr, false)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			base.Content = append(base.Content, lr)
+		}
+	}
+}
+
+// scalarOf returns the scalar value of key in the mapping n, empty when it
+// has none.
+func scalarOf(n *yaml.Node, key string) string {
+	if n.Kind != yaml.MappingNode {
+		return ""
+	}
+	if i := indexOfKey(n, key); i >= 0 && n.Content[i+1].Kind == yaml.ScalarNode {
+		return n.Content[i+1].Value
+	}
+	return ""
+}
+
+// copyNode deep copies n, the copy is from the file of n. The templates of
+// lr-map paths are evaluated in place, per node.
+func (v *validator) copyNode(n *yaml.Node) *yaml.Node {
+	c := *n
+	v.files[&c] = v.files[n]
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i := range n.Content {
+		c.Content[i] = v.copyNode(n.Content[i])
+	}
+	return &c
+}
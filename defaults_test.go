@@ -0,0 +1,128 @@
+package scpw
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDefaultsAndTemplates(t *testing.T) {
+	nodes, err := ParseConfig("scpw.yml", []byte(`
+defaults:
+  user: deploy
+  port: 2222
+  keypath: /home/me/.ssh/id_ed25519
+  lr-map:
+  - { local: /etc/motd, remote: /tmp/motd }
+templates:
+  web:
+    type: PUT
+    vars: { app: shop, env: prod }
+    lr-map:
+    - { local: /srv/app, remote: /srv/app, verify: sha256 }
+  staging:
+    extends: web
+    vars: { env: staging }
+    lr-map:
+    - { local: /srv/app, remote: /srv/staging }
+nodes:
+- name: web1
+  host: 10.0.0.1
+  extends: web
+- name: stage1
+  host: 10.0.0.2
+  user: ci
+  extends: [staging]
+  lr-map:
+  - { local: /srv/extra, remote: /srv/extra }
+- name: group
+  type: GET
+  children:
+  - { name: child, host: 10.0.0.3, lr-map: [{ local: /a, remote: /b }] }
+`))
+	require.Nil(t, err)
+	require.Len(t, nodes, 3)
+
+	web1 := nodes[0]
+	assert.Equal(t, "deploy", web1.User)
+	assert.Equal(t, "2222", web1.Port)
+	assert.Equal(t, "/home/me/.ssh/id_ed25519", web1.KeyPath)
+	assert.Equal(t, PUT, web1.Typ)
+	assert.Equal(t, map[string]string{"app": "shop", "env": "prod"}, web1.Vars)
+	assert.Equal(t, []LRMap{
+		{Local: "/etc/motd", Remote: "/tmp/motd"},
+		{Local: "/srv/app", Remote: "/srv/app", Verify: SHA256},
+	}, web1.LRMap)
+
+	stage1 := nodes[1]
+	assert.Equal(t, "ci", stage1.User)
+	assert.Equal(t, map[string]string{"app": "shop", "env": "staging"}, stage1.Vars)
+	assert.Equal(t, []LRMap{
+		{Local: "/etc/motd", Remote: "/tmp/motd"},
+		{Local: "/srv/app", Remote: "/srv/staging", Verify: SHA256},
+		{Local: "/srv/extra", Remote: "/srv/extra"},
+	}, stage1.LRMap)
+
+	// a group gets the defaults but for lr-map, its children inherit them
+	group := nodes[2]
+	assert.Equal(t, "deploy", group.User)
+	assert.Nil(t, group.LRMap)
+	child := group.Children[0]
+	assert.Equal(t, "", child.User)
+	assert.Equal(t, []LRMap{{Local: "/etc/motd", Remote: "/tmp/motd"}, {Local: "/a", Remote: "/b"}}, child.LRMap)
+
+	// the template of a path is evaluated per node
+	nodes, err = ParseConfig("scpw.yml", []byte(`
+templates:
+  t:
+    user: root
+    type: PUT
+    lr-map: [{ local: /tmp/a, remote: "/tmp/{{.Node.Name}}" }]
+nodes:
+- { name: a, host: 10.0.0.1, extends: t }
+- { name: b, host: 10.0.0.2, extends: t }
+`))
+	require.Nil(t, err)
+	assert.Equal(t, "/tmp/a", nodes[0].LRMap[0].Remote)
+	assert.Equal(t, "/tmp/b", nodes[1].LRMap[0].Remote)
+}
+
+func TestDefaultsAcrossFiles(t *testing.T) {
+	team := ConfigFile{Path: "team.yml", Data: []byte(`
+defaults: { user: deploy, type: PUT }
+templates:
+  app: { lr-map: [{ local: /srv/app, remote: /srv/app }] }
+nodes:
+- { name: web, host: 10.0.0.1, extends: app }
+`)}
+	// a legacy list uses the defaults and templates of the other files
+	personal := ConfigFile{Path: "personal.yml", Data: []byte(`
+- { name: sandbox, host: 10.0.0.9, extends: app }
+`)}
+	nodes, err := ParseConfigFiles([]ConfigFile{team, personal})
+	require.Nil(t, err)
+	require.Len(t, nodes, 2)
+	assert.Equal(t, "deploy", nodes[1].User)
+	assert.Equal(t, "/srv/app", nodes[1].LRMap[0].Local)
+}
+
+func TestDefaultsErrors(t *testing.T) {
+	_, err := ParseConfig("scpw.yml", []byte(`
+defaults:
+  name: x
+  usr: deploy
+templates:
+  a: { extends: b }
+  b: { extends: a }
+nodes:
+- { name: web, host: 10.0.0.1, user: root, type: PUT, extends: c, lr-map: [{ local: /a, remote: /b }] }
+- { name: db, host: 10.0.0.2, user: root, type: PUT, extends: a, lr-map: [{ local: /a, remote: /b }] }
+node: []
+`))
+	require.IsType(t, ConfigErrors{}, err)
+	assert.Equal(t, `scpw.yml:3:3: name is not allowed in defaults
+scpw.yml:4:3: unknown field "usr" in defaults, did you mean "user"?
+scpw.yml:7:17: template cycle a -> b -> a
+scpw.yml:9:64: unknown template "c"
+scpw.yml:11:1: unknown field "node" in config, did you mean "nodes"?`, err.Error())
+}
@@ -0,0 +1,125 @@
+package scpw
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// EncryptedExt ends the name of an encrypted config.
+const EncryptedExt = ".enc"
+
+// ConfigKeyFile holds the passphrase of encrypted configs, it is asked on the
+// terminal when empty.
+var ConfigKeyFile string
+
+var (
+	configPassMu sync.Mutex
+	// configPass is asked once, a config may include several encrypted files
+	configPass []byte
+)
+
+// ConfigPassphrase returns the passphrase of encrypted configs from
+// ConfigKeyFile or the terminal, confirm asks twice for a new one.
+func ConfigPassphrase(confirm bool) ([]byte, error) {
+	configPassMu.Lock()
+	defer configPassMu.Unlock()
+	if configPass != nil {
+		return configPass, nil
+	}
+	var pass []byte
+	var err error
+	if ConfigKeyFile != "" {
+		if pass, err = os.ReadFile(ConfigKeyFile); err != nil {
+			return nil, fmt.Errorf("read key file failed! e: %v", err)
+		}
+		pass = bytes.TrimRight(pass, "\r\n")
+		if len(pass) == 0 {
+			return nil, fmt.Errorf("key file:[%s] is empty", ConfigKeyFile)
+		}
+	} else if pass, err = ReadPassphrase("config passphrase: ", confirm); err != nil {
+		return nil, err
+	}
+	configPass = pass
+	return pass, nil
+}
+
+// ReadConfigData reads a config file, an encrypted one is decrypted whatever
+// its name.
+func ReadConfigData(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config failed! e: %v", err)
+	}
+	if !IsSealed(data) {
+		return data, nil
+	}
+	pass, err := ConfigPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = Unseal(pass, data); err != nil {
+		return nil, fmt.Errorf("decrypt config:[%s] failed! e: %v", path, err)
+	}
+	return data, nil
+}
+
+// WriteConfigData writes plaintext to path through a temp file, encrypted
+// when path ends with EncryptedExt.
+func WriteConfigData(path string, plaintext []byte) error {
+	data := plaintext
+	if strings.HasSuffix(path, EncryptedExt) {
+		pass, err := ConfigPassphrase(true)
+		if err != nil {
+			return err
+		}
+		if data, err = Seal(pass, plaintext); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// EncryptConfigFile encrypts the config path into path+EncryptedExt and
+// removes path.
+func EncryptConfigFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if IsSealed(data) {
+		return "", fmt.Errorf("config:[%s] is already encrypted", path)
+	}
+	dst := path + EncryptedExt
+	if err = writeNew(dst, data); err != nil {
+		return "", err
+	}
+	return dst, os.Remove(path)
+}
+
+// DecryptConfigFile decrypts the config path, which ends with EncryptedExt,
+// into the name without it and removes path.
+func DecryptConfigFile(path string) (string, error) {
+	if !strings.HasSuffix(path, EncryptedExt) {
+		return "", fmt.Errorf("config:[%s] does not end with %s", path, EncryptedExt)
+	}
+	data, err := ReadConfigData(path)
+	if err != nil {
+		return "", err
+	}
+	dst := strings.TrimSuffix(path, EncryptedExt)
+	if err = writeNew(dst, data); err != nil {
+		return "", err
+	}
+	return dst, os.Remove(path)
+}
+
+// writeNew is WriteConfigData refusing to replace a file.
+func writeNew(path string, plaintext []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("config:[%s] already exists", path)
+	}
+	return WriteConfigData(path, plaintext)
+}
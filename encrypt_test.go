@@ -0,0 +1,100 @@
+package scpw
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useKeyFile makes the encrypted configs of a test use pass.
+func useKeyFile(t *testing.T, pass string) {
+	n, keyFile := scryptN, ConfigKeyFile
+	t.Cleanup(func() { scryptN, ConfigKeyFile, configPass = n, keyFile, nil })
+	scryptN, configPass = 1<<10, nil
+	ConfigKeyFile = filepath.Join(t.TempDir(), "key")
+	require.Nil(t, os.WriteFile(ConfigKeyFile, []byte(pass+"\n"), 0600))
+}
+
+func TestEncryptConfigFile(t *testing.T) {
+	useKeyFile(t, "passphrase")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "scpw.yml")
+	content := "- { name: web, host: 10.0.0.1, user: root, type: PUT, lr-map: [{ local: /tmp/a, remote: /tmp/b }] }\n"
+	require.Nil(t, os.WriteFile(path, []byte(content), 0644))
+
+	enc, err := EncryptConfigFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, path+EncryptedExt, enc)
+	assert.NoFileExists(t, path)
+	data, err := os.ReadFile(enc)
+	require.Nil(t, err)
+	assert.True(t, IsSealed(data))
+	stat, err := os.Stat(enc)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	_, err = EncryptConfigFile(enc)
+	assert.NotNil(t, err)
+
+	// loaded and included transparently
+	config, err := ReadConfig(enc)
+	require.Nil(t, err)
+	assert.Equal(t, "web", config.Nodes[0].Name)
+	main := filepath.Join(dir, "main.yml")
+	require.Nil(t, os.WriteFile(main, []byte("- include: scpw.yml.enc\n"), 0644))
+	config, err = ReadConfig(main)
+	require.Nil(t, err)
+	assert.Equal(t, "web", config.Nodes[0].Name)
+
+	configPass = []byte("wrong")
+	_, err = ReadConfig(enc)
+	assert.NotNil(t, err)
+	configPass = nil
+
+	// an existing plaintext is never replaced
+	require.Nil(t, os.WriteFile(path, []byte("other"), 0644))
+	_, err = DecryptConfigFile(enc)
+	assert.NotNil(t, err)
+	require.Nil(t, os.Remove(path))
+
+	dec, err := DecryptConfigFile(enc)
+	require.Nil(t, err)
+	assert.Equal(t, path, dec)
+	assert.NoFileExists(t, enc)
+	data, err = os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, content, string(data))
+	_, err = DecryptConfigFile(path)
+	assert.NotNil(t, err)
+}
+
+func TestWriteConfigData(t *testing.T) {
+	useKeyFile(t, "passphrase")
+	dir := t.TempDir()
+	require.Nil(t, WriteConfigData(filepath.Join(dir, "scpw.yml.enc"), []byte("- name: a\n")))
+	require.Nil(t, WriteConfigData(filepath.Join(dir, "scpw.yml"), []byte("- name: a\n")))
+	for _, name := range []string{"scpw.yml.enc", "scpw.yml"} {
+		data, err := ReadConfigData(filepath.Join(dir, name))
+		require.Nil(t, err)
+		assert.Equal(t, "- name: a\n", string(data))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "scpw.yml"))
+	require.Nil(t, err)
+	assert.False(t, IsSealed(data))
+}
+
+func TestConfigPassphrase(t *testing.T) {
+	useKeyFile(t, "passphrase")
+	pass, err := ConfigPassphrase(false)
+	require.Nil(t, err)
+	assert.Equal(t, "passphrase", string(pass))
+
+	configPass = nil
+	require.Nil(t, os.WriteFile(ConfigKeyFile, []byte("\n"), 0600))
+	_, err = ConfigPassphrase(false)
+	assert.NotNil(t, err)
+	ConfigKeyFile = filepath.Join(t.TempDir(), "not-exist")
+	_, err = ConfigPassphrase(false)
+	assert.NotNil(t, err)
+}
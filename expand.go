@@ -0,0 +1,180 @@
+package scpw
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// envRef matches `${VAR}`, `${VAR:-default}` and the escape `$${`.
+var envRef = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces the variables of s by their values from lookup, a default
+// is used when the variable is unset or empty. An unset variable without a
+// default is an error, an empty path is rarely what was meant.
+func expandEnv(s string, lookup func(string) (string, bool)) (string, error) {
+	var err error
+	out := envRef.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$${" {
+			return "${"
+		}
+		sub := envRef.FindStringSubmatch(m)
+		value, ok := lookup(sub[1])
+		switch {
+		case sub[2] != "" && value == "":
+			return sub[3]
+		case !ok && err == nil:
+			err = fmt.Errorf("environment variable %s is not set", sub[1])
+		}
+		return value
+	})
+	return out, err
+}
+
+// envKeys are the fields environment variables are expanded in, passwords
+// and hook commands are taken as they are written.
+var envKeys = map[string]bool{
+	"host": true, "port": true, "user": true, "keypath": true,
+	"local": true, "remote": true, "backup-dir": true, "remote-backup-dir": true, "include": true,
+}
+
+// expandEnvNode expands the environment variables in the values of envKeys and
+// vars under n.
+func (v *validator) expandEnvNode(n *yaml.Node) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i].Value, n.Content[i+1]
+			switch {
+			case envKeys[key]:
+				v.expandEnvValue(value)
+			case key == "vars" && value.Kind == yaml.MappingNode:
+				for j := 1; j < len(value.Content); j += 2 {
+					v.expandEnvValue(value.Content[j])
+				}
+			default:
+				v.expandEnvNode(value)
+			}
+		}
+	default:
+		for _, c := range n.Content {
+			v.expandEnvNode(c)
+		}
+	}
+}
+
+func (v *validator) expandEnvValue(n *yaml.Node) {
+	// `include` takes a list of paths too
+	if n.Kind == yaml.SequenceNode {
+		for _, c := range n.Content {
+			v.expandEnvValue(c)
+		}
+		return
+	}
+	if n.Kind != yaml.ScalarNode || !strings.Contains(n.Value, "${") {
+		return
+	}
+	value, err := expandEnv(n.Value, os.LookupEnv)
+	if err != nil {
+		v.errorf(n, "%v", err)
+		return
+	}
+	n.Value = value
+	// a plain scalar is resolved again, `${PORT}` may be an int
+	if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+		n.Tag = ""
+	}
+}
+
+// TemplateNode is the node a path template is evaluated for, with the
+// fields it inherits.
+type TemplateNode struct {
+	Name string
+	Host string
+	User string
+	Port string
+	Type SCPWType
+}
+
+// TemplateData is what the templates in lr-map paths see, `{{.Date}}`,
+// `{{.Node.Name}}` or `{{.Vars.version}}`.
+type TemplateData struct {
+	Now  time.Time
+	Date string
+	Time string
+	Node TemplateNode
+	Vars map[string]string
+}
+
+// expandTemplates evaluates the templates of the lr-map paths of the nodes of
+// seq, children see the vars of their parents.
+func (v *validator) expandTemplates(seq *yaml.Node, parent TemplateData) {
+	for _, n := range seq.Content {
+		if n.Kind != yaml.MappingNode {
+			continue
+		}
+		data := parent
+		data.Node.Name = ""
+		fields := map[string]*string{"name": &data.Node.Name, "host": &data.Node.Host, "user": &data.Node.User, "port": &data.Node.Port, "type": &data.Node.Type}
+		for key, field := range fields {
+			if i := indexOfKey(n, key); i >= 0 && n.Content[i+1].Kind == yaml.ScalarNode {
+				*field = n.Content[i+1].Value
+			}
+		}
+		if i := indexOfKey(n, "vars"); i >= 0 && n.Content[i+1].Kind == yaml.MappingNode {
+			vars := n.Content[i+1]
+			data.Vars = map[string]string{}
+			for k, value := range parent.Vars {
+				data.Vars[k] = value
+			}
+			for j := 0; j+1 < len(vars.Content); j += 2 {
+				data.Vars[vars.Content[j].Value] = vars.Content[j+1].Value
+			}
+		}
+		// the paths see the port and user the node logs in with, children
+		// resolve their own
+		paths := data
+		if paths.Node.Host != "" {
+			paths.Node.Host, paths.Node.Port, paths.Node.User = resolveLogin(paths.Node.Host, paths.Node.Port, paths.Node.User)
+		}
+		if i := indexOfKey(n, "lr-map"); i >= 0 && n.Content[i+1].Kind == yaml.SequenceNode {
+			for _, lr := range n.Content[i+1].Content {
+				if lr.Kind != yaml.MappingNode {
+					continue
+				}
+				for _, key := range []string{"local", "remote"} {
+					if j := indexOfKey(lr, key); j >= 0 {
+						v.expandTemplate(lr.Content[j+1], paths)
+					}
+				}
+			}
+		}
+		if i := indexOfKey(n, "children"); i >= 0 && n.Content[i+1].Kind == yaml.SequenceNode {
+			v.expandTemplates(n.Content[i+1], data)
+		}
+	}
+}
+
+func (v *validator) expandTemplate(n *yaml.Node, data TemplateData) {
+	if n.Kind != yaml.ScalarNode || !strings.Contains(n.Value, "{{") {
+		return
+	}
+	t, err := template.New("").Option("missingkey=error").Parse(n.Value)
+	if err == nil {
+		b := &strings.Builder{}
+		if err = t.Execute(b, data); err == nil {
+			n.Value = b.String()
+			return
+		}
+	}
+	v.errorf(n, "%v", err)
+}
+
+// newTemplateData is the data of the top level nodes, evaluated at now.
+func newTemplateData(now time.Time) TemplateData {
+	return TemplateData{Now: now, Date: now.Format("2006-01-02"), Time: now.Format("150405"), Vars: map[string]string{}}
+}
@@ -0,0 +1,113 @@
+package scpw
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os/user"
+	"testing"
+	"time"
+)
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{"USER": "me", "EMPTY": ""}
+	lookup := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+	for s, expected := range map[string]string{
+		"/home/${USER}/app":   "/home/me/app",
+		"${EMPTY}":            "",
+		"${EMPTY:-x}":         "x",
+		"${MISSING:-/tmp/a}":  "/tmp/a",
+		"${MISSING:-}":        "",
+		"$${USER} ${USER}":    "${USER} me",
+		"pa$$word $USER":      "pa$$word $USER",
+		"${USER}-${USER:-no}": "me-me",
+	} {
+		actual, err := expandEnv(s, lookup)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, actual, s)
+	}
+	_, err := expandEnv("/home/${MISSING}", lookup)
+	assert.EqualError(t, err, "environment variable MISSING is not set")
+}
+
+func TestParseConfigExpand(t *testing.T) {
+	t.Setenv("SCPW_TEST_HOST", "10.0.0.1")
+	t.Setenv("SCPW_TEST_VERSION", "1.3")
+	config, err := ParseConfig("scpw.yml", []byte(`
+- name: group
+  user: deploy
+  type: PUT
+  vars: { app: shop, version: "1.2" }
+  children:
+  - name: web
+    host: ${SCPW_TEST_HOST}
+    port: ${SCPW_TEST_PORT:-2222}
+    password: pa${ss}
+    pre-hooks: [ "echo ${HOME}" ]
+    vars: { version: "${SCPW_TEST_VERSION}" }
+    lr-map:
+    - local: /build/{{.Vars.app}}-{{.Vars.version}}.tar
+      remote: /srv/{{.Node.Name}}/{{.Node.User}}/{{.Date}}/
+`))
+	require.Nil(t, err)
+	web := config[0].Children[0]
+	assert.Equal(t, "10.0.0.1", web.Host)
+	assert.Equal(t, "2222", web.Port)
+	assert.Equal(t, "pa${ss}", web.Password)
+	assert.Equal(t, []string{"echo ${HOME}"}, web.PreHooks)
+	assert.Equal(t, "/build/shop-1.3.tar", web.LRMap[0].Local)
+	assert.Equal(t, "/srv/web/deploy/"+time.Now().Format("2006-01-02")+"/", web.LRMap[0].Remote)
+
+	_, err = ParseConfig("scpw.yml", []byte(`
+- name: web
+  host: ${SCPW_TEST_MISSING}
+  user: deploy
+  type: PUT
+  vars: [a]
+  lr-map:
+  - { local: "/build/{{.Vars.missing}}", remote: "/srv/{{.Node.Name" }
+`))
+	require.IsType(t, ConfigErrors{}, err)
+	errs := err.(ConfigErrors)
+	require.Len(t, errs, 4)
+	assert.Equal(t, "scpw.yml:3:9: environment variable SCPW_TEST_MISSING is not set", errs[0].Error())
+	assert.Equal(t, "scpw.yml:6:9: vars expects a mapping, got a list", errs[1].Error())
+	assert.Contains(t, errs[2].Error(), `scpw.yml:8:14: template: :1:14: executing "" at <.Vars.missing>: map has no entry for key "missing"`)
+	assert.Equal(t, "scpw.yml:8:50: template: :1: unclosed action", errs[3].Error())
+}
+
+func TestExpandDefaults(t *testing.T) {
+	defer func(f func(string) string) { sshConfigUser = f }(sshConfigUser)
+	sshConfigUser = func(host string) string {
+		if host == "10.0.0.2" {
+			return "ssh-user"
+		}
+		return ""
+	}
+	u, err := user.Current()
+	require.Nil(t, err)
+
+	// the paths see the port and user a node logs in with, defaults too
+	nodes, err := ParseConfig("scpw.yml", []byte(`
+- name: group
+  type: PUT
+  children:
+  - { name: a, host: "10.0.0.1:2200", lr-map: [{ local: /a, remote: "/srv/{{.Node.Host}}/{{.Node.Port}}/{{.Node.User}}" }] }
+  - { name: b, host: 10.0.0.2, lr-map: [{ local: /b, remote: "/srv/{{.Node.Host}}/{{.Node.Port}}/{{.Node.User}}" }] }
+`))
+	require.Nil(t, err)
+	assert.Equal(t, "/srv/10.0.0.1/2200/"+loginName(u), nodes[0].Children[0].LRMap[0].Remote)
+	assert.Equal(t, "/srv/10.0.0.2/22/ssh-user", nodes[0].Children[1].LRMap[0].Remote)
+}
+
+func TestInheritVars(t *testing.T) {
+	nodes := []*Node{{Name: "group", Vars: map[string]string{"a": "1", "b": "2"}, Children: []*Node{
+		{Name: "x", Vars: map[string]string{"b": "3"}},
+		{Name: "y"},
+	}}}
+	inherit(nodes, nil, nil)
+	assert.Equal(t, map[string]string{"a": "1", "b": "3"}, nodes[0].Children[0].Vars)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, nodes[0].Children[1].Vars)
+}
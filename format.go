@@ -0,0 +1,98 @@
+package scpw
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ConfigFormat is the syntax of a config file.
+type ConfigFormat = string
+
+const (
+	YAML ConfigFormat = "yaml"
+	JSON ConfigFormat = "json"
+	TOML ConfigFormat = "toml"
+)
+
+// ConfigFormats are the formats a config is read and written in.
+var ConfigFormats = []ConfigFormat{YAML, JSON, TOML}
+
+// DetectFormat returns the format of a config by the extension of path,
+// EncryptedExt aside, else by its content.
+func DetectFormat(path string, data []byte) ConfigFormat {
+	switch filepath.Ext(strings.TrimSuffix(path, EncryptedExt)) {
+	case ".json":
+		return JSON
+	case ".toml":
+		return TOML
+	case ".yml", ".yaml":
+		return YAML
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return JSON
+	}
+	// a YAML config is never a TOML table, a comment only file is empty in both
+	var table map[string]interface{}
+	if err := toml.Unmarshal(data, &table); err == nil && len(table) > 0 {
+		return TOML
+	}
+	return YAML
+}
+
+var tomlLine = regexp.MustCompile(`^toml: line \d+( \(last key "[^"]*"\))?: `)
+
+// parseDocument parses a config into a yaml tree, nil when it is empty.
+// JSON is read as YAML, which it is, so its errors have positions. A TOML
+// tree has no positions, its errors name the file only.
+func parseDocument(path string, data []byte) (*yaml.Node, error) {
+	if DetectFormat(path, data) != TOML {
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, yamlError(path, err)
+		}
+		if len(doc.Content) == 0 {
+			return nil, nil
+		}
+		return doc.Content[0], nil
+	}
+	var table map[string]interface{}
+	if _, err := toml.Decode(string(data), &table); err != nil {
+		if e, ok := err.(toml.ParseError); ok {
+			return nil, ConfigErrors{{File: path, Line: e.Position.Line, Msg: tomlLine.ReplaceAllString(e.Error(), "")}}
+		}
+		return nil, ConfigErrors{{File: path, Msg: err.Error()}}
+	}
+	if len(table) == 0 {
+		return nil, nil
+	}
+	var root yaml.Node
+	if err := root.Encode(table); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// WriteConfigAs writes nodes in format, a TOML config is a document with a
+// table array of nodes.
+func WriteConfigAs(w io.Writer, nodes []*Node, format ConfigFormat) error {
+	switch format {
+	case YAML:
+		return WriteConfig(w, nodes)
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(nodes)
+	case TOML:
+		return toml.NewEncoder(w).Encode(struct {
+			Nodes []*Node `toml:"nodes"`
+		}{nodes})
+	}
+	return fmt.Errorf("invalid format %q, expect one of %s", format, strings.Join(ConfigFormats, ", "))
+}
@@ -0,0 +1,83 @@
+package scpw
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	assert.Equal(t, JSON, DetectFormat(".scpw.json", nil))
+	assert.Equal(t, TOML, DetectFormat(".scpw.toml.enc", nil))
+	assert.Equal(t, YAML, DetectFormat(".scpw.yml", []byte(`[[nodes]]`)))
+	assert.Equal(t, JSON, DetectFormat(".scpw", []byte(` [{"name": "web"}]`)))
+	assert.Equal(t, TOML, DetectFormat(".scpw", []byte("[[nodes]]\nname = \"web\"\n")))
+	assert.Equal(t, YAML, DetectFormat(".scpw", []byte("- name: web\n")))
+	assert.Equal(t, YAML, DetectFormat(".scpw", []byte("# nothing yet\n")))
+}
+
+func TestParseConfigFormats(t *testing.T) {
+	want := []*Node{{
+		Name:  "web",
+		Host:  "10.0.0.1",
+		User:  "root",
+		Port:  "2222",
+		Typ:   PUT,
+		Split: true,
+		LRMap: []LRMap{{Local: "/srv/app", Remote: "/srv/app", Chunks: 4}},
+	}}
+	nodes, err := ParseConfig("scpw.json", []byte(`[
+  {"name": "web", "host": "10.0.0.1", "user": "root", "port": 2222, "type": "PUT", "split": true,
+   "lr-map": [{"local": "/srv/app", "remote": "/srv/app", "chunks": 4}]}
+]`))
+	require.Nil(t, err)
+	assert.Equal(t, want, nodes)
+
+	nodes, err = ParseConfig("scpw.toml", []byte(`
+[defaults]
+user = "root"
+
+[[nodes]]
+name = "web"
+host = "10.0.0.1"
+port = 2222
+type = "PUT"
+split = true
+
+  [[nodes.lr-map]]
+  local = "/srv/app"
+  remote = "/srv/app"
+  chunks = 4
+`))
+	require.Nil(t, err)
+	assert.Equal(t, want, nodes)
+
+	// JSON errors have positions, TOML validation errors only the file
+	_, err = ParseConfig("scpw.json", []byte(`[{"name": "web", "hots": "10.0.0.1"}]`))
+	assert.Contains(t, err.Error(), `scpw.json:1:18: unknown field "hots" in node, did you mean "host"?`)
+	_, err = ParseConfig("scpw.toml", []byte("[[nodes]]\nname = \"web\"\nhots = \"10.0.0.1\"\n"))
+	assert.Contains(t, err.Error(), `scpw.toml: unknown field "hots" in node, did you mean "host"?`)
+	_, err = ParseConfig("scpw.toml", []byte("[[nodes]\n"))
+	assert.Equal(t, `scpw.toml:2: expected end of table array name delimiter ']', but got '\n' instead`, err.Error())
+}
+
+func TestWriteConfigAs(t *testing.T) {
+	nodes := []*Node{{
+		Name:     "group",
+		User:     "deploy",
+		Vars:     map[string]string{"env": "prod"},
+		Children: []*Node{{Name: "web", Host: "10.0.0.1", Typ: GET, LRMap: []LRMap{{Local: "/a", Remote: "/b", Verify: SHA256}}}},
+	}}
+	for _, format := range ConfigFormats {
+		b := &bytes.Buffer{}
+		require.Nil(t, WriteConfigAs(b, nodes, format), format)
+		read, err := ParseConfig("scpw."+format, b.Bytes())
+		require.Nil(t, err, format)
+		assert.Equal(t, nodes, read, format)
+	}
+	b := &bytes.Buffer{}
+	require.Nil(t, WriteConfigAs(b, nodes, TOML))
+	assert.NotContains(t, b.String(), "chunks")
+	assert.NotNil(t, WriteConfigAs(b, nodes, "xml"))
+}
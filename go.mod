@@ -3,15 +3,19 @@ module github.com/T-TRz879/scpw
 go 1.19
 
 require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/cespare/xxhash/v2 v2.2.0
 	github.com/google/gops v0.3.27
 	github.com/google/uuid v1.3.0
+	github.com/kevinburke/ssh_config v1.2.0
 	github.com/manifoldco/promptui v0.9.0
 	github.com/sirupsen/logrus v1.9.0
 	github.com/stretchr/testify v1.8.1
 	github.com/urfave/cli/v2 v2.4.0
 	github.com/vbauerster/mpb/v8 v8.7.2
 	golang.org/x/crypto v0.4.0
-	gopkg.in/yaml.v2 v2.4.0
+	golang.org/x/term v0.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -27,5 +31,4 @@ require (
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
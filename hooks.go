@@ -0,0 +1,111 @@
+package scpw
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+)
+
+type HookPolicy = string
+
+const (
+	// HookSkip skips post hooks when the transfer failed
+	HookSkip HookPolicy = "skip"
+	// HookForce runs post hooks even when the transfer failed
+	HookForce HookPolicy = "force"
+)
+
+// hookLogWriter streams hook output into the log line by line.
+type hookLogWriter struct {
+	prefix string
+	buf    []byte
+}
+
+func (w *hookLogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Infof("%s %s", w.prefix, bytes.TrimRight(w.buf[:i], "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *hookLogWriter) Flush() {
+	if len(w.buf) > 0 {
+		log.Infof("%s %s", w.prefix, w.buf)
+		w.buf = nil
+	}
+}
+
+// RunRemoteHook runs cmd over a new session of cli, a non-zero exit status is an error.
+func RunRemoteHook(cli *ssh.Client, cmd string) error {
+	session, err := cli.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	out := &hookLogWriter{prefix: fmt.Sprintf("[remote hook:%s]", cmd)}
+	defer out.Flush()
+	session.Stdout, session.Stderr = out, out
+	if err = session.Run(cmd); err != nil {
+		return fmt.Errorf("remote hook:[%s] failed! e: %v", cmd, err)
+	}
+	return nil
+}
+
+// RunLocalHook runs cmd in the local shell, a non-zero exit status is an error.
+func RunLocalHook(cmd string) error {
+	c := ShellCommand(cmd)
+	out := &hookLogWriter{prefix: fmt.Sprintf("[local hook:%s]", cmd)}
+	defer out.Flush()
+	c.Stdout, c.Stderr = out, out
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("local hook:[%s] failed! e: %v", cmd, err)
+	}
+	return nil
+}
+
+func (n *Node) HasRemoteHooks() bool {
+	return len(n.PreHooks) > 0 || len(n.PostHooks) > 0
+}
+
+// RunPreHooks runs the local then the remote pre hooks, it stops at the first failure.
+func (n *Node) RunPreHooks(cli *ssh.Client) error {
+	for _, cmd := range n.LocalPreHooks {
+		if err := RunLocalHook(cmd); err != nil {
+			return err
+		}
+	}
+	for _, cmd := range n.PreHooks {
+		if err := RunRemoteHook(cli, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunPostHooks runs the remote then the local post hooks. When the transfer failed
+// they are skipped unless `post-hooks-on-failure` is `force`.
+func (n *Node) RunPostHooks(cli *ssh.Client, transferErr error) error {
+	if transferErr != nil && n.PostHooksOnFailure != HookForce {
+		if len(n.PostHooks)+len(n.LocalPostHooks) > 0 {
+			log.Warnf("transfer failed, skip post hooks of node:[%s]", n.Name)
+		}
+		return nil
+	}
+	for _, cmd := range n.PostHooks {
+		if err := RunRemoteHook(cli, cmd); err != nil {
+			return err
+		}
+	}
+	for _, cmd := range n.LocalPostHooks {
+		if err := RunLocalHook(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package scpw
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestHookLogWriter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	SetOutput(buf)
+	defer SetOutput(os.Stderr)
+
+	w := &hookLogWriter{prefix: "[hook]"}
+	_, err := w.Write([]byte("line1\nli"))
+	require.Nil(t, err)
+	_, err = w.Write([]byte("ne2\r\nline3"))
+	require.Nil(t, err)
+	w.Flush()
+	assert.Contains(t, buf.String(), "[hook] line1")
+	assert.Contains(t, buf.String(), "[hook] line2")
+	assert.Contains(t, buf.String(), "[hook] line3")
+}
+
+func TestRunLocalHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks use sh")
+	}
+	assert.Nil(t, RunLocalHook("echo hello"))
+	assert.NotNil(t, RunLocalHook("exit 3"))
+}
+
+func TestRunHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks use sh")
+	}
+	marker := filepath.Join(t.TempDir(), "post")
+	node := &Node{LocalPreHooks: []string{"true"}, LocalPostHooks: []string{"touch " + marker}}
+	require.Nil(t, node.RunPreHooks(nil))
+	assert.False(t, node.HasRemoteHooks())
+
+	// skipped on transfer failure
+	require.Nil(t, node.RunPostHooks(nil, errors.New("transfer failed")))
+	_, err := os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+
+	node.PostHooksOnFailure = HookForce
+	require.Nil(t, node.RunPostHooks(nil, errors.New("transfer failed")))
+	_, err = os.Stat(marker)
+	assert.Nil(t, err)
+
+	node.LocalPreHooks = []string{"false"}
+	assert.NotNil(t, node.RunPreHooks(nil))
+}
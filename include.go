@@ -0,0 +1,202 @@
+package scpw
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ConfigDir holds config files that are loaded with the default config, in
+// the home dir.
+const ConfigDir = ".scpw.d"
+
+// loader reads config files and splices the nodes of their includes, an
+// item `- include: <path or glob>` or `- include: [...]` in the node list.
+// Relative paths are resolved from the dir of the including file. The
+// defaults and templates of all files are collected, see extend.
+type loader struct {
+	v *validator
+	// defaults are merged from all files
+	defaults *yaml.Node
+	// templates are by name, a later file replaces a template
+	templates map[string]*yaml.Node
+	// resolved are the templates with what they extend merged in
+	resolved map[string]*yaml.Node
+	// typeErr is the first value of a wrong type, reported when the validator
+	// found nothing since the tree may not even be a node list
+	typeErr error
+	// stack are the files being loaded, an include cycle would never end
+	stack []string
+}
+
+// load parses a file and returns its node list with the includes spliced in,
+// nil when it is empty or invalid. The file is a list of nodes, or a document
+// with the keys of documentKeys, in one of ConfigFormats.
+func (l *loader) load(path string, data []byte) (*yaml.Node, error) {
+	root, err := parseDocument(path, data)
+	// empty file
+	if err != nil || root == nil {
+		return nil, err
+	}
+	l.v.own(root, path)
+	l.v.expandEnvNode(root)
+	items, include := root, (*yaml.Node)(nil)
+	switch root.Kind {
+	case yaml.SequenceNode:
+	case yaml.MappingNode:
+		fields := l.v.mapping(root, "config", documentKeys)
+		if items = fields["nodes"]; items != nil && items.Kind != yaml.SequenceNode {
+			l.v.errorf(items, "nodes expects a list of nodes, got %s", kindOf(items))
+			items = nil
+		}
+		include = fields["include"]
+		if defaults := fields["defaults"]; defaults != nil {
+			l.addDefaults(path, defaults)
+		}
+		if templates := fields["templates"]; templates != nil {
+			l.addTemplates(path, templates)
+		}
+	default:
+		l.v.errorf(root, "expect a list of nodes or a mapping of %s", strings.Join(documentKeys, ", "))
+		return nil, nil
+	}
+
+	l.stack = append(l.stack, absPath(path))
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: root.Line, Column: root.Column}
+	l.v.own(seq, path)
+	if include != nil {
+		if err := l.include(seq, path, include); err != nil {
+			return nil, err
+		}
+	}
+	var own []*yaml.Node
+	if items != nil {
+		for _, item := range items.Content {
+			i := -1
+			if item.Kind == yaml.MappingNode {
+				i = indexOfKey(item, "include")
+			}
+			if i < 0 {
+				own = append(own, item)
+				seq.Content = append(seq.Content, item)
+				continue
+			}
+			if len(item.Content) > 2 {
+				l.v.errorf(item, "include takes no other keys")
+				continue
+			}
+			if err := l.include(seq, path, item.Content[i+1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// the items of this file only, the included ones check themselves
+	var nodes []*Node
+	if err := (&yaml.Node{Kind: yaml.SequenceNode, Content: own}).Decode(&nodes); err != nil && l.typeErr == nil {
+		l.typeErr = yamlError(path, err)
+	}
+	return seq, nil
+}
+
+// include splices the files of an include value, a path or a list of paths,
+// into seq. path is the including file.
+func (l *loader) include(seq *yaml.Node, path string, value *yaml.Node) error {
+	patterns := []*yaml.Node{value}
+	if value.Kind == yaml.SequenceNode {
+		patterns = value.Content
+	}
+	for _, pattern := range patterns {
+		if pattern.Kind != yaml.ScalarNode || pattern.Value == "" {
+			l.v.errorf(pattern, "include expects a path or a list of paths")
+			continue
+		}
+		matches, err := includePaths(filepath.Dir(path), pattern.Value)
+		if err != nil {
+			l.v.errorf(pattern, "%v", err)
+			continue
+		}
+		for _, match := range matches {
+			if _, err = l.splice(seq, pattern, match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splice loads path and appends its nodes to seq, which is created when nil.
+// at is the include it was named by, nil for the includes of a ConfigFile.
+func (l *loader) splice(seq, at *yaml.Node, path string) (*yaml.Node, error) {
+	for i, loading := range l.stack {
+		if loading == absPath(path) {
+			cycle := append(append([]string{}, l.stack[i:]...), loading)
+			l.v.errorf(at, "include cycle %s", strings.Join(cycle, " -> "))
+			return seq, nil
+		}
+	}
+	data, err := ReadConfigData(path)
+	if err != nil {
+		if at == nil {
+			return nil, err
+		}
+		l.v.errorf(at, "include failed! e: %v", err)
+		return seq, nil
+	}
+	included, err := l.load(path, data)
+	if err != nil || included == nil {
+		return seq, err
+	}
+	if seq == nil {
+		return included, nil
+	}
+	seq.Content = append(seq.Content, included.Content...)
+	return seq, nil
+}
+
+// includePaths resolves an include from dir. A glob may match nothing, a
+// plain path must exist.
+func includePaths(dir, pattern string) ([]string, error) {
+	if strings.HasPrefix(pattern, "~/") {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		pattern = filepath.Join(u.HomeDir, pattern[2:])
+	} else if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %q", pattern)
+	}
+	return matches, nil
+}
+
+// ConfigDirFiles returns the yml, yaml, json and toml files of dir,
+// encrypted ones too, sorted by name. None when dir does not exist.
+func ConfigDirFiles(dir string) ([]string, error) {
+	var files []string
+	for _, ext := range []string{"*.yml", "*.yaml", "*.json", "*.toml", "*.yml.enc", "*.yaml.enc", "*.json.enc", "*.toml.enc"} {
+		matches, err := filepath.Glob(filepath.Join(dir, ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
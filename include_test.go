@@ -0,0 +1,79 @@
+package scpw
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.Nil(t, os.WriteFile(path, []byte(content), 0600))
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "scpw.yml")
+	writeConfig(t, main, `
+- { name: a, host: 10.0.0.1, user: root, type: PUT, lr-map: [{ local: /tmp/a, remote: /tmp/a }] }
+- include: teams/*.yml
+- include: [extra.yml]
+`)
+	writeConfig(t, filepath.Join(dir, "teams", "db.yml"), "- { name: db, host: 10.0.0.2, user: root, type: GET, lr-map: [{ local: /tmp/db, remote: /tmp/db }] }\n")
+	writeConfig(t, filepath.Join(dir, "teams", "web.yml"), "- { name: web, host: 10.0.0.3, user: root, type: PUT, lr-map: [{ local: /tmp/web, remote: /tmp/web }] }\n")
+	writeConfig(t, filepath.Join(dir, "extra.yml"), "- { name: extra, host: 10.0.0.4, user: root, type: PUT, lr-map: [{ local: /tmp/x, remote: /tmp/x }] }\n")
+
+	b, err := os.ReadFile(main)
+	require.Nil(t, err)
+	nodes, read, _, err := parseConfigFiles([]ConfigFile{{Path: main, Data: b}})
+	require.Nil(t, err)
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	assert.Equal(t, []string{"a", "db", "web", "extra"}, names)
+	assert.Equal(t, []string{main, filepath.Join(dir, "teams", "db.yml"), filepath.Join(dir, "teams", "web.yml"), filepath.Join(dir, "extra.yml")}, read)
+
+	// included nodes are not overrides, a duplicate is reported with its file
+	writeConfig(t, filepath.Join(dir, "extra.yml"), `- { name: web, host: 10.0.0.4, user: root, type: PUT, lr-map: [{ local: /tmp/x, remote: /tmp/x }] }
+- { name: bad, host: 10.0.0.5, user: root, type: PUT, chunks: many, lr-map: [{ local: /tmp/x, remote: /tmp/x }] }
+`)
+	_, err = ParseConfig(main, b)
+	assert.Equal(t, filepath.Join(dir, "extra.yml")+`:1:11: duplicate node name "web", first defined at `+filepath.Join(dir, "teams", "web.yml")+":1", err.Error())
+	writeConfig(t, filepath.Join(dir, "extra.yml"), "- { name: bad, host: 10.0.0.5, user: root, type: PUT, chunks: many, lr-map: [{ local: /tmp/x, remote: /tmp/x }] }\n")
+	_, err = ParseConfig(main, b)
+	assert.Contains(t, err.Error(), filepath.Join(dir, "extra.yml")+":1: cannot unmarshal")
+
+	// cycles, missing files and extra keys
+	writeConfig(t, filepath.Join(dir, "extra.yml"), "- include: ../"+filepath.Base(dir)+"/scpw.yml\n- include: missing.yml\n- { include: x.yml, name: x }\n")
+	_, err = ParseConfig(main, b)
+	require.IsType(t, ConfigErrors{}, err)
+	errs := err.(ConfigErrors)
+	require.Len(t, errs, 3)
+	assert.Equal(t, "include cycle "+main+" -> "+filepath.Join(dir, "extra.yml")+" -> "+main, errs[0].Msg)
+	assert.Contains(t, errs[1].Msg, "include failed!")
+	assert.Equal(t, "include takes no other keys", errs[2].Msg)
+}
+
+func TestConfigDirIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, filepath.Join(dir, "b.yaml"), "- { name: b, host: 10.0.0.2, user: root, type: GET, lr-map: [{ local: /tmp/b, remote: /tmp/b }] }\n")
+	writeConfig(t, filepath.Join(dir, "a.yml"), "- { name: a, host: 10.0.0.1, user: root, type: PUT, lr-map: [{ local: /tmp/a, remote: /tmp/a }] }\n")
+	writeConfig(t, filepath.Join(dir, "notes.txt"), "not a config")
+
+	files, err := ConfigDirFiles(dir)
+	require.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "a.yml"), filepath.Join(dir, "b.yaml")}, files)
+	files, err = ConfigDirFiles(filepath.Join(dir, "not-exist"))
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	// without a main config
+	nodes, err := ParseConfigFiles([]ConfigFile{{Path: dir, Includes: []string{filepath.Join(dir, "a.yml"), filepath.Join(dir, "b.yaml")}}})
+	require.Nil(t, err)
+	require.Len(t, nodes, 2)
+	assert.Equal(t, "a", nodes[0].Name)
+	assert.Equal(t, "b", nodes[1].Name)
+}
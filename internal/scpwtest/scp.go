@@ -0,0 +1,310 @@
+package scpwtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type scpOption struct {
+	sink      bool
+	source    bool
+	recursive bool
+	keepTime  bool
+	target    string
+}
+
+// parseSCPCommand parses `scp -[rtfpd] path` as sent by scpw, the path may be quoted.
+func parseSCPCommand(command string) (scpOption, error) {
+	var opt scpOption
+	rest := strings.TrimSpace(strings.TrimPrefix(command, "scp "))
+	for strings.HasPrefix(rest, "-") {
+		i := strings.IndexByte(rest, ' ')
+		if i < 0 {
+			return opt, fmt.Errorf("scp: missing path in %q", command)
+		}
+		for _, flag := range rest[1:i] {
+			switch flag {
+			case 't':
+				opt.sink = true
+			case 'f':
+				opt.source = true
+			case 'r':
+				opt.recursive = true
+			case 'p':
+				opt.keepTime = true
+			case 'd', 'v':
+			default:
+				return opt, fmt.Errorf("scp: unknown option -%c", flag)
+			}
+		}
+		rest = strings.TrimSpace(rest[i+1:])
+	}
+	if opt.sink == opt.source {
+		return opt, fmt.Errorf("scp: exactly one of -t and -f is required")
+	}
+	if unquoted, err := strconv.Unquote(rest); err == nil {
+		rest = unquoted
+	}
+	if rest == "" {
+		return opt, fmt.Errorf("scp: missing path in %q", command)
+	}
+	opt.target = rest
+	return opt, nil
+}
+
+type scpSession struct {
+	root string
+	opt  scpOption
+	rw   io.ReadWriter
+	in   *bufio.Reader
+}
+
+func (s *scpSession) run() error {
+	s.in = bufio.NewReader(s.rw)
+	target := s.opt.target
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(s.root, target)
+	}
+	if s.opt.sink {
+		return s.sink(target)
+	}
+	return s.source(target)
+}
+
+// fail reports err to the client the way scp does, with a 0x01 prefixed line.
+func (s *scpSession) fail(err error) error {
+	fmt.Fprintf(s.rw, "\x01scp: %v\n", err)
+	return err
+}
+
+func (s *scpSession) ack() error {
+	_, err := s.rw.Write([]byte{0})
+	return err
+}
+
+func (s *scpSession) readAck() error {
+	b, err := s.in.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != 0 {
+		msg, _ := s.in.ReadString('\n')
+		return fmt.Errorf("scp: client error %q", strings.TrimSpace(msg))
+	}
+	return nil
+}
+
+type sinkDir struct {
+	path         string
+	atime, mtime time.Time
+	hasTime      bool
+}
+
+func (s *scpSession) sink(target string) error {
+	stat, err := os.Stat(target)
+	targetIsDir := err == nil && stat.IsDir()
+	var stack []sinkDir
+	var atime, mtime time.Time
+	hasTime := false
+
+	if err = s.ack(); err != nil {
+		return err
+	}
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) && line == "" {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return s.fail(fmt.Errorf("empty protocol line"))
+		}
+		switch line[0] {
+		case 'T':
+			var ms, as, zero int64
+			if _, err = fmt.Sscanf(line, "T%d %d %d %d", &ms, &zero, &as, &zero); err != nil {
+				return s.fail(fmt.Errorf("bad time %q", line))
+			}
+			atime, mtime, hasTime = time.Unix(as, 0), time.Unix(ms, 0), s.opt.keepTime
+		case 'E':
+			if len(stack) == 0 {
+				return s.fail(fmt.Errorf("unexpected E"))
+			}
+			dir := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if dir.hasTime {
+				if err = os.Chtimes(dir.path, dir.atime, dir.mtime); err != nil {
+					return s.fail(err)
+				}
+			}
+		case 'C', 'D':
+			mode, size, name, err := parseHeader(line)
+			if err != nil {
+				return s.fail(err)
+			}
+			path := target
+			if len(stack) > 0 {
+				path = filepath.Join(stack[len(stack)-1].path, name)
+			} else if targetIsDir {
+				path = filepath.Join(target, name)
+			}
+			if line[0] == 'D' {
+				if err = s.mkdir(path, mode); err != nil {
+					return s.fail(err)
+				}
+				stack = append(stack, sinkDir{path: path, atime: atime, mtime: mtime, hasTime: hasTime})
+			} else {
+				// ready for the content
+				if err = s.ack(); err != nil {
+					return err
+				}
+				if err = s.receiveFile(path, mode, size); err != nil {
+					return s.fail(err)
+				}
+				if hasTime {
+					if err = os.Chtimes(path, atime, mtime); err != nil {
+						return s.fail(err)
+					}
+				}
+			}
+			hasTime = false
+		case '\x01', '\x02':
+			return fmt.Errorf("scp: client error %q", line[1:])
+		default:
+			return s.fail(fmt.Errorf("unknown protocol line %q", line))
+		}
+		if err = s.ack(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *scpSession) mkdir(path string, mode os.FileMode) error {
+	if !s.opt.recursive {
+		return fmt.Errorf("received directory without -r")
+	}
+	if stat, err := os.Stat(path); err == nil {
+		if !stat.IsDir() {
+			return fmt.Errorf("%s: Not a directory", path)
+		}
+	} else if err = os.Mkdir(path, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+func parseHeader(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("bad header %q", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("bad mode %q", line)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("bad size %q", line)
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return 0, 0, "", fmt.Errorf("bad name %q", name)
+	}
+	return os.FileMode(mode), size, name, nil
+}
+
+func (s *scpSession) receiveFile(path string, mode os.FileMode, size int64) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		// drain the content so the stream stays in sync before reporting
+		io.CopyN(io.Discard, s.in, size+1)
+		return err
+	}
+	_, err = io.CopyN(file, s.in, size)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.readAck(); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+func (s *scpSession) source(target string) error {
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	stat, err := os.Stat(target)
+	if err != nil {
+		return s.fail(fmt.Errorf("%s: No such file or directory", s.opt.target))
+	}
+	if stat.IsDir() && !s.opt.recursive {
+		return s.fail(fmt.Errorf("%s: not a regular file", s.opt.target))
+	}
+	return s.send(target, stat)
+}
+
+func (s *scpSession) send(path string, stat os.FileInfo) error {
+	if s.opt.keepTime {
+		// access times are not portable, send the modification time for both
+		fmt.Fprintf(s.rw, "T%d 0 %d 0\n", stat.ModTime().Unix(), stat.ModTime().Unix())
+		if err := s.readAck(); err != nil {
+			return err
+		}
+	}
+	if !stat.IsDir() {
+		return s.sendFile(path, stat)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return s.fail(err)
+	}
+	fmt.Fprintf(s.rw, "D%04o 0 %s\n", stat.Mode().Perm(), stat.Name())
+	if err = s.readAck(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		childStat, err := os.Stat(child)
+		if err != nil {
+			return s.fail(err)
+		}
+		if err = s.send(child, childStat); err != nil {
+			return err
+		}
+	}
+	fmt.Fprint(s.rw, "E\n")
+	return s.readAck()
+}
+
+func (s *scpSession) sendFile(path string, stat os.FileInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return s.fail(err)
+	}
+	defer file.Close()
+	fmt.Fprintf(s.rw, "C%04o %d %s\n", stat.Mode().Perm(), stat.Size(), stat.Name())
+	if err = s.readAck(); err != nil {
+		return err
+	}
+	if _, err = io.CopyN(s.rw, file, stat.Size()); err != nil {
+		return err
+	}
+	if err = s.ack(); err != nil {
+		return err
+	}
+	return s.readAck()
+}
@@ -0,0 +1,49 @@
+package scpwtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSCPCommand(t *testing.T) {
+	opt, err := parseSCPCommand(`scp -rtp "/tmp/a b"`)
+	require.Nil(t, err)
+	assert.Equal(t, scpOption{sink: true, recursive: true, keepTime: true, target: "/tmp/a b"}, opt)
+
+	opt, err = parseSCPCommand(`scp -f  "x"`)
+	require.Nil(t, err)
+	assert.Equal(t, scpOption{source: true, target: "x"}, opt)
+
+	for _, cmd := range []string{`scp -t`, `scp -tf "x"`, `scp -z "x"`, `scp "x"`} {
+		_, err = parseSCPCommand(cmd)
+		assert.NotNil(t, err, cmd)
+	}
+}
+
+func TestServerShell(t *testing.T) {
+	s, err := NewServer(t.TempDir(), "u", "p")
+	require.Nil(t, err)
+	defer s.Close()
+
+	_, err = ssh.Dial("tcp", s.Addr(), &ssh.ClientConfig{User: "u", Auth: []ssh.AuthMethod{ssh.Password("x")}, HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	assert.NotNil(t, err)
+
+	cli, err := ssh.Dial("tcp", s.Addr(), &ssh.ClientConfig{User: "u", Auth: []ssh.AuthMethod{ssh.Password("p")}, HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	require.Nil(t, err)
+	defer cli.Close()
+	session, err := cli.NewSession()
+	require.Nil(t, err)
+	out, err := session.Output("pwd")
+	require.Nil(t, err)
+	assert.Equal(t, s.Root+"\n", string(out))
+
+	session, err = cli.NewSession()
+	require.Nil(t, err)
+	err = session.Run("exit 3")
+	exitErr, ok := err.(*ssh.ExitError)
+	require.True(t, ok)
+	assert.Equal(t, 3, exitErr.ExitStatus())
+}
@@ -0,0 +1,168 @@
+// Package scpwtest provides an in-process SSH server speaking the scp
+// protocol, so scpw can be tested without a local sshd or scp binary.
+package scpwtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is an SSH server listening on a random local port. `scp -t/-f`
+// commands are served in-process, every other command runs through `sh -c`
+// with Root as working directory. Relative remote paths resolve against Root.
+type Server struct {
+	Host     string
+	Port     string
+	Root     string
+	User     string
+	Password string
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server accepting user/password logins.
+func NewServer(root, user, password string) (*Server, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Root: root, User: user, Password: password}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if conn.User() == s.User && string(pass) == s.Password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", conn.User())
+		},
+	}
+	s.config.AddHostKey(signer)
+
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.Host, s.Port, err = net.SplitHostPort(s.listener.Addr().String())
+	if err != nil {
+		s.listener.Close()
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, s.Port)
+}
+
+// Close stops accepting connections and waits for the accept loop.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(ch, requests)
+	}
+}
+
+func (s *Server) handleSession(ch ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go func() {
+			status := s.exec(ch, payload.Command)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			ch.Close()
+		}()
+	}
+}
+
+func (s *Server) exec(ch ssh.Channel, command string) uint32 {
+	if strings.HasPrefix(command, "scp ") {
+		opt, err := parseSCPCommand(command)
+		if err != nil {
+			fmt.Fprintf(ch.Stderr(), "%v\n", err)
+			return 1
+		}
+		if err = (&scpSession{root: s.Root, opt: opt, rw: ch}).run(); err != nil {
+			return 1
+		}
+		return 0
+	}
+	return s.shell(ch, command)
+}
+
+func (s *Server) shell(ch ssh.Channel, command string) uint32 {
+	c := exec.Command("sh", "-c", command)
+	c.Dir = s.Root
+	c.Stdout, c.Stderr = ch, ch.Stderr()
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return 1
+	}
+	// the channel is only closed by the client, do not make Wait depend on it
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	if err = c.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return uint32(exitErr.ExitCode())
+		}
+		fmt.Fprintf(ch.Stderr(), "%v\n", err)
+		return 127
+	}
+	return 0
+}
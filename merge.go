@@ -0,0 +1,79 @@
+package scpw
+
+import "gopkg.in/yaml.v3"
+
+// mergeNodes overlays the node list over onto base, both yaml sequences. A
+// node of over is merged into the node of the same name in base or its
+// children, see mergeNode, so an override need not repeat the groups of a
+// node. The other nodes are appended. Two nodes of one file with the same
+// name are kept apart so the validator reports them.
+func mergeNodes(base, over *yaml.Node) {
+	index := map[string]*yaml.Node{}
+	indexNodes(base, index)
+	merged := map[string]bool{}
+	for _, n := range over.Content {
+		name := nameOf(n)
+		if b, ok := index[name]; ok && !merged[name] {
+			mergeNode(b, n)
+			merged[name] = true
+			continue
+		}
+		base.Content = append(base.Content, n)
+	}
+}
+
+// indexNodes adds the nodes of seq and their children to index by name, the
+// first of a name wins.
+func indexNodes(seq *yaml.Node, index map[string]*yaml.Node) {
+	for _, n := range seq.Content {
+		if name := nameOf(n); name != "" {
+			if _, ok := index[name]; !ok {
+				index[name] = n
+			}
+		}
+		if n.Kind != yaml.MappingNode {
+			continue
+		}
+		if i := indexOfKey(n, "children"); i >= 0 && n.Content[i+1].Kind == yaml.SequenceNode {
+			indexNodes(n.Content[i+1], index)
+		}
+	}
+}
+
+// mergeNode sets the keys of the mapping over on base, children are merged by
+// name and every other value, lr-map included, replaces the one of base.
+func mergeNode(base, over *yaml.Node) {
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		key, value := over.Content[i], over.Content[i+1]
+		j := indexOfKey(base, key.Value)
+		switch {
+		case j < 0:
+			base.Content = append(base.Content, key, value)
+		case key.Value == "children" && base.Content[j+1].Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+			mergeNodes(base.Content[j+1], value)
+		default:
+			base.Content[j], base.Content[j+1] = key, value
+		}
+	}
+}
+
+// nameOf returns the name of a node mapping, empty when it has none.
+func nameOf(n *yaml.Node) string {
+	if n.Kind != yaml.MappingNode {
+		return ""
+	}
+	if i := indexOfKey(n, "name"); i >= 0 && n.Content[i+1].Kind == yaml.ScalarNode {
+		return n.Content[i+1].Value
+	}
+	return ""
+}
+
+// indexOfKey returns the index of key in the mapping n, -1 when it is absent.
+func indexOfKey(n *yaml.Node, key string) int {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
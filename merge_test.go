@@ -0,0 +1,91 @@
+package scpw
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseConfigFiles(t *testing.T) {
+	team := ConfigFile{Path: "team.yml", Data: []byte(`
+- name: group
+  user: deploy
+  type: PUT
+  children:
+  - name: web
+    host: 10.0.0.1
+    lr-map: [{ local: /srv/app, remote: /srv/app }]
+  - name: db
+    host: 10.0.0.2
+    lr-map: [{ local: /srv/db, remote: /srv/db }]
+- name: backup
+  host: 10.0.0.3
+  user: deploy
+  type: GET
+  lr-map: [{ local: /backup, remote: /var/backup }]
+`)}
+	personal := ConfigFile{Path: "personal.yml", Data: []byte(`
+- name: group
+  user: me
+  keypath: /home/me/.ssh/id_ed25519
+  children:
+  - name: web
+    lr-map: [{ local: /home/me/app, remote: /srv/app }]
+- name: sandbox
+  host: 10.0.0.9
+  user: me
+  type: PUT
+  lr-map: [{ local: /tmp/a, remote: /tmp/b }]
+`)}
+	nodes, err := ParseConfigFiles([]ConfigFile{team, personal})
+	require.Nil(t, err)
+	require.Len(t, nodes, 3)
+	group := nodes[0]
+	assert.Equal(t, "me", group.User)
+	assert.Equal(t, "/home/me/.ssh/id_ed25519", group.KeyPath)
+	assert.Equal(t, PUT, group.Typ)
+	require.Len(t, group.Children, 2)
+	// lr-map is replaced, the other keys of a child are kept
+	assert.Equal(t, "10.0.0.1", group.Children[0].Host)
+	assert.Equal(t, []LRMap{{Local: "/home/me/app", Remote: "/srv/app"}}, group.Children[0].LRMap)
+	assert.Equal(t, "db", group.Children[1].Name)
+	assert.Equal(t, "backup", nodes[1].Name)
+	assert.Equal(t, "sandbox", nodes[2].Name)
+
+	// a child is found without its group
+	nodes, err = ParseConfigFiles([]ConfigFile{team, {Path: "personal.yml", Data: []byte("- { name: db, host: 10.0.0.5 }\n")}})
+	require.Nil(t, err)
+	require.Len(t, nodes, 2)
+	assert.Equal(t, "10.0.0.5", nodes[0].Children[1].Host)
+
+	// an override cannot make a node invalid unnoticed, errors name their file
+	_, err = ParseConfigFiles([]ConfigFile{team, {Path: "personal.yml", Data: []byte(`
+- name: backup
+  type: get
+- name: extra
+  host: 10.0.0.9
+- name: extra
+  user: me
+`)}})
+	assert.Equal(t, `personal.yml:3:9: invalid type "get", expect PUT or GET
+personal.yml:4:3: missing type
+personal.yml:4:3: missing lr-map
+personal.yml:6:3: missing host
+personal.yml:6:3: missing type
+personal.yml:6:3: missing lr-map
+personal.yml:6:9: duplicate node name "extra", first defined at line 4`, err.Error())
+
+	_, err = ParseConfigFiles([]ConfigFile{team, {Path: "personal.yml", Data: []byte(`
+- name: sandbox
+  host: 10.0.0.9
+  user: me
+  type: PUT
+  lr-map: [{ local: /tmp/a, remote: /tmp/b }]
+  children:
+  - { name: web, host: 10.0.0.1, lr-map: [{ local: /tmp/a, remote: /tmp/b }] }
+`)}})
+	assert.Equal(t, `personal.yml:8:13: duplicate node name "web", first defined at team.yml:6`, err.Error())
+
+	_, err = ParseConfigFiles([]ConfigFile{team, {Path: "personal.yml", Data: []byte("name: web\n")}})
+	assert.Equal(t, `personal.yml:1:1: unknown field "name" in config`, err.Error())
+}
@@ -4,18 +4,60 @@ import (
 	"fmt"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+type ProgressMode = string
+
+const (
+	ProgressBars  ProgressMode = "bars"
+	ProgressPlain ProgressMode = "plain"
+	ProgressNone  ProgressMode = "none"
+)
+
+// plainInterval is the period of the progress lines of plain mode.
+var plainInterval = 10 * time.Second
+
 type Progress struct {
 	*mpb.Progress
 	bars []*mpb.Bar
+	mode ProgressMode
+	out  io.Writer
 }
 
 func NewProgress() *Progress {
 	return &Progress{
 		mpb.New(mpb.WithWidth(64)),
 		[]*mpb.Bar{},
+		ProgressBars,
+		os.Stdout,
+	}
+}
+
+// NewProgressMode renders bars to out, or prints a progress line to out
+// periodically in plain mode, or nothing at all.
+func NewProgressMode(mode ProgressMode, out io.Writer) (*Progress, error) {
+	switch mode {
+	case ProgressBars:
+		return &Progress{mpb.New(mpb.WithWidth(64), mpb.WithOutput(out)), []*mpb.Bar{}, mode, out}, nil
+	case ProgressPlain, ProgressNone:
+		// bars still count, nobody sees them
+		return &Progress{mpb.New(mpb.WithOutput(io.Discard)), []*mpb.Bar{}, mode, out}, nil
 	}
+	return nil, fmt.Errorf("invalid progress:[%s]", mode)
+}
+
+// IsTerminal reports whether f is a terminal, escape sequences of the bars
+// are garbage in a cron mail or a CI log.
+func IsTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
 }
 
 func (p *Progress) NewInfiniteByesBar(name string) *mpb.Bar {
@@ -27,3 +69,205 @@ func (p *Progress) NewInfiniteByesBar(name string) *mpb.Bar {
 	p.bars = append(p.bars, bar)
 	return bar
 }
+
+// Tracker follows the transfers of a node: an aggregate bar over the
+// pre-computed totals with the count of finished files, and one line per file
+// in flight.
+type Tracker struct {
+	p     *Progress
+	name  string
+	total *mpb.Bar
+	files int64
+	done  int64
+	// size and sent feed the lines of plain mode
+	size  int64
+	sent  int64
+	start time.Time
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewTracker adds the aggregate bar of name, one per node.
+func (p *Progress) NewTracker(name string) *Tracker {
+	t := &Tracker{p: p, name: name}
+	t.total = p.AddBar(0,
+		mpb.PrependDecorators(
+			decor.Name(fmt.Sprintf("%-35s", name)+" | "),
+			decor.Counters(decor.SizeB1024(0), "% .1f / % .1f"),
+			decor.Any(func(decor.Statistics) string {
+				return fmt.Sprintf(" | files %d/%d", atomic.LoadInt64(&t.done), atomic.LoadInt64(&t.files))
+			}),
+		),
+		mpb.AppendDecorators(
+			decor.Percentage(),
+			decor.EwmaSpeed(decor.SizeB1024(0), " | % .1f", 30),
+			decor.Name(" | ETA "),
+			decor.EwmaETA(decor.ET_STYLE_GO, 30),
+		),
+	)
+	p.bars = append(p.bars, t.total)
+	t.start = time.Now()
+	if p.mode == ProgressPlain {
+		t.stop = make(chan struct{})
+		t.wg.Add(1)
+		go t.printLoop()
+	}
+	return t
+}
+
+func (t *Tracker) printLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(plainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.printLine()
+		case <-t.stop:
+			t.printLine()
+			return
+		}
+	}
+}
+
+// printLine writes the state of the run as one line.
+func (t *Tracker) printLine() {
+	sent, size := atomic.LoadInt64(&t.sent), atomic.LoadInt64(&t.size)
+	line := fmt.Sprintf("%s %s % .1f / % .1f", time.Now().Format("2006/01/02 15:04:05"), t.name, decor.SizeB1024(sent), decor.SizeB1024(size))
+	if size > 0 {
+		line += fmt.Sprintf(" %d%%", MinInt64(sent*100/size, 100))
+	}
+	line += fmt.Sprintf(" | files %d/%d", atomic.LoadInt64(&t.done), atomic.LoadInt64(&t.files))
+	if elapsed := time.Since(t.start).Seconds(); elapsed > 0 && sent > 0 {
+		speed := float64(sent) / elapsed
+		line += fmt.Sprintf(" | % .1f/s", decor.SizeB1024(int64(speed)))
+		if size > sent {
+			line += fmt.Sprintf(" | ETA %s", time.Duration(float64(size-sent)/speed*float64(time.Second)).Round(time.Second))
+		}
+	}
+	fmt.Fprintln(t.p.out, line)
+}
+
+// Add grows the totals, called before the transfers start.
+func (t *Tracker) Add(files, size int64) {
+	atomic.AddInt64(&t.files, files)
+	t.total.SetTotal(atomic.AddInt64(&t.size, size), false)
+}
+
+// Done completes the aggregate bar, the estimated totals may be off.
+func (t *Tracker) Done() {
+	t.total.SetTotal(-1, true)
+	if t.stop != nil {
+		close(t.stop)
+		t.wg.Wait()
+	}
+}
+
+// FileBar is the line of one file, chunks of the same file share it.
+type FileBar struct {
+	t   *Tracker
+	bar *mpb.Bar
+}
+
+// Start adds the line of a file of size bytes.
+func (t *Tracker) Start(name string, size int64) *FileBar {
+	f := &FileBar{t: t}
+	// a zero total never completes
+	if size > 0 {
+		f.bar = t.p.AddBar(size,
+			mpb.BarRemoveOnComplete(),
+			mpb.PrependDecorators(decor.Name(fmt.Sprintf("%-35s", name)+" | "), decor.Counters(decor.SizeB1024(0), "% .1f / % .1f")),
+			mpb.AppendDecorators(
+				decor.Percentage(),
+				decor.EwmaSpeed(decor.SizeB1024(0), " | % .1f", 30),
+				decor.Name(" | ETA "),
+				decor.EwmaETA(decor.ET_STYLE_GO, 30),
+			),
+		)
+	}
+	return f
+}
+
+// Reader counts what is read from r into the file line and the aggregate.
+func (f *FileBar) Reader(r io.Reader) io.Reader {
+	return &trackedReader{r: r, f: f, last: time.Now()}
+}
+
+// Finish removes the line and counts the file, a failed file is not counted.
+func (f *FileBar) Finish(err error) {
+	// a complete line is already gone, a short one is dropped
+	if f.bar != nil {
+		f.bar.Abort(true)
+	}
+	if err == nil {
+		atomic.AddInt64(&f.t.done, 1)
+	}
+}
+
+type trackedReader struct {
+	r    io.Reader
+	f    *FileBar
+	last time.Time
+}
+
+func (tr *trackedReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		now := time.Now()
+		dur := now.Sub(tr.last)
+		tr.last = now
+		if tr.f.bar != nil {
+			tr.f.bar.EwmaIncrBy(n, dur)
+		}
+		tr.f.t.total.EwmaIncrBy(n, dur)
+		atomic.AddInt64(&tr.f.t.sent, int64(n))
+	}
+	return n, err
+}
+
+// LocalTotal counts the files and bytes a PUT of localPath sends.
+func LocalTotal(localPath string) (files, size int64, err error) {
+	tree, err := SplitTree(localPath, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	if tree != nil {
+		return int64(len(tree.Files)), tree.Size, nil
+	}
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return 1, stat.Size(), nil
+}
+
+// RemoteTotal counts the files and bytes a GET of remotePath receives. GNU and
+// busybox du disagree on -b, -k is the fallback and only an estimate.
+func (scp *SCP) RemoteTotal(remotePath string) (files, size int64, err error) {
+	if len(remotePath) > 1 {
+		remotePath = strings.TrimRight(remotePath, "/\\")
+	}
+	out, err := scp.Output(fmt.Sprintf("find %q -type f | wc -l", remotePath))
+	if err != nil {
+		return 0, 0, fmt.Errorf("remote find failed! e: %v", err)
+	}
+	if files, err = strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid file count %q", out)
+	}
+	unit := int64(1)
+	out, err = scp.Output(fmt.Sprintf("du -sb %q", remotePath))
+	if err != nil {
+		unit = 1024
+		if out, err = scp.Output(fmt.Sprintf("du -sk %q", remotePath)); err != nil {
+			return 0, 0, fmt.Errorf("remote du failed! e: %v", err)
+		}
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return 0, 0, fmt.Errorf("invalid du output %q", out)
+	}
+	if size, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid du output %q", out)
+	}
+	return files, size * unit, nil
+}
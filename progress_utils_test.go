@@ -1,8 +1,17 @@
 package scpw
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewProgress(t *testing.T) {
@@ -10,3 +19,147 @@ func TestNewProgress(t *testing.T) {
 	bar := progress.NewInfiniteByesBar("")
 	assert.True(t, bar.IsRunning())
 }
+
+func TestTracker(t *testing.T) {
+	progress := NewProgress()
+	tracker := progress.NewTracker("total")
+	// one Add per lr-map entry, the bar total is their sum
+	tracker.Add(3, 12)
+	tracker.Add(1, 9)
+
+	f := tracker.Start("a", 8)
+	n, err := io.Copy(io.Discard, f.Reader(bytes.NewReader(make([]byte, 8))))
+	require.Nil(t, err)
+	assert.Equal(t, int64(8), n)
+	f.Finish(nil)
+	tracker.Start("b", 0).Finish(nil)
+	tracker.Start("c", 4).Finish(errors.New("failed"))
+	f = tracker.Start("d", 9)
+	_, err = io.Copy(io.Discard, f.Reader(bytes.NewReader(make([]byte, 9))))
+	require.Nil(t, err)
+	f.Finish(nil)
+
+	assert.Equal(t, int64(4), tracker.files)
+	assert.Equal(t, int64(3), tracker.done)
+	assert.Equal(t, int64(17), tracker.total.Current())
+	// a bar completes at once when it has reached its total, 17 of 21 has not
+	tracker.total.EnableTriggerComplete()
+	assert.False(t, tracker.total.Completed())
+	// Done cannot complete it anymore, the missing bytes do
+	tracker.total.IncrBy(4)
+	tracker.Done()
+	progress.Wait()
+}
+
+func TestLocalTotal(t *testing.T) {
+	files, size, err := LocalTotal(baseLocalDir)
+	require.Nil(t, err)
+	assert.GreaterOrEqual(t, files, int64(2))
+	assert.GreaterOrEqual(t, size, int64(8))
+
+	files, size, err = LocalTotal(filepath.Join(baseLocalDir, "a"))
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), files)
+	assert.Equal(t, int64(4), size)
+
+	_, _, err = LocalTotal(filepath.Join(tmpDir, "not-exist"))
+	assert.NotNil(t, err)
+}
+
+func TestRemoteTotal(t *testing.T) {
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	remote := RandName(tmpDir)
+	require.Nil(t, mkdir(remote))
+	require.Nil(t, writeFile(filepath.Join(remote, "a")))
+	require.Nil(t, writeFile(filepath.Join(remote, "b")))
+	files, size, err := scpwCli.RemoteTotal(remote + "/")
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), files)
+	assert.GreaterOrEqual(t, size, int64(8))
+
+	_, _, err = scpwCli.RemoteTotal(filepath.Join(tmpDir, "not-exist"))
+	assert.NotNil(t, err)
+}
+
+func TestTrackedTransfer(t *testing.T) {
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+	progress := NewProgress()
+	tracker := progress.NewTracker("total")
+	tracker.Add(3, 12)
+	ctx := Context{Ctx: context.Background(), Tracker: tracker}
+
+	local, remote := RandName(tmpDir), RandName(tmpDir)
+	require.Nil(t, writeFile(local))
+	require.Nil(t, scpwCli.SwitchScpwFunc(ctx, local, remote, PUT))
+	assertSameFile(t, local, remote)
+	back := RandName(tmpDir)
+	require.Nil(t, scpwCli.SwitchScpwFunc(ctx, back, remote, GET))
+	assertSameFile(t, remote, back)
+	remoteDir, localDir := RandName(tmpDir), RandName(tmpDir)
+	require.Nil(t, mkdir(remoteDir))
+	require.Nil(t, writeFile(filepath.Join(remoteDir, "c")))
+	require.Nil(t, mkdir(localDir))
+	require.Nil(t, scpwCli.SwitchScpwFunc(ctx, localDir, remoteDir+"/", GET))
+
+	assert.Equal(t, int64(3), tracker.done)
+	assert.Equal(t, int64(12), tracker.total.Current())
+	tracker.Done()
+	progress.Wait()
+}
+
+func TestProgressMode(t *testing.T) {
+	_, err := NewProgressMode("fancy", io.Discard)
+	assert.NotNil(t, err)
+
+	file, err := os.CreateTemp(tmpDir, "out")
+	require.Nil(t, err)
+	defer file.Close()
+	assert.False(t, IsTerminal(file))
+
+	// a char device is not a terminal
+	null, err := os.Open(os.DevNull)
+	require.Nil(t, err)
+	defer null.Close()
+	assert.False(t, IsTerminal(null))
+}
+
+func TestPlainTracker(t *testing.T) {
+	interval := plainInterval
+	defer func() { plainInterval = interval }()
+	plainInterval = 10 * time.Millisecond
+
+	out := &bytes.Buffer{}
+	progress, err := NewProgressMode(ProgressPlain, out)
+	require.Nil(t, err)
+	tracker := progress.NewTracker("total")
+	tracker.Add(1, 2048)
+	f := tracker.Start("a", 2048)
+	_, err = io.Copy(io.Discard, f.Reader(bytes.NewReader(make([]byte, 2048))))
+	require.Nil(t, err)
+	f.Finish(nil)
+	time.Sleep(30 * time.Millisecond)
+	tracker.Done()
+	progress.Wait()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.GreaterOrEqual(t, len(lines), 2)
+	assert.Contains(t, lines[len(lines)-1], "total 2.0 KiB / 2.0 KiB 100% | files 1/1")
+	assert.NotContains(t, out.String(), "\x1b")
+
+	out.Reset()
+	progress, err = NewProgressMode(ProgressNone, out)
+	require.Nil(t, err)
+	tracker = progress.NewTracker("total")
+	tracker.Add(1, 4)
+	tracker.Start("a", 4).Finish(nil)
+	tracker.Done()
+	progress.Wait()
+	assert.Empty(t, out.String())
+}
@@ -0,0 +1,104 @@
+package scpw
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket, one Limiter shared by several transfers keeps
+// their aggregate rate under the cap.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of kbps KB/s, nil when kbps is not positive.
+func NewLimiter(kbps int64) *Limiter {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1024
+	// allow one second of traffic, at least one copy buffer
+	burst := rate
+	if burst < float64(ONCE_LEN) {
+		burst = float64(ONCE_LEN)
+	}
+	return &Limiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long the caller must wait for them,
+// the bucket may go into debt so reads larger than the burst still pass.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may pass or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	wait := l.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > ONCE_LEN {
+		p = p[:ONCE_LEN]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		for _, l := range lr.limiters {
+			if e := l.WaitN(lr.ctx, n); e != nil {
+				return n, e
+			}
+		}
+	}
+	return n, err
+}
+
+// LimitReader throttles r by every non-nil limiter.
+func LimitReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	var active []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return r
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &limitedReader{ctx: ctx, r: r, limiters: active}
+}
@@ -0,0 +1,50 @@
+package scpw
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNewLimiter(t *testing.T) {
+	assert.Nil(t, NewLimiter(0))
+	assert.Nil(t, NewLimiter(-1))
+
+	r := bytes.NewReader(nil)
+	assert.Equal(t, r, LimitReader(context.Background(), r, nil, nil))
+}
+
+func TestLimitReader(t *testing.T) {
+	l := NewLimiter(256)
+	data := make([]byte, 384*1024)
+	start := time.Now()
+	// the first 256KB are the burst, the rest waits about half a second
+	n, err := io.Copy(io.Discard, LimitReader(context.Background(), bytes.NewReader(data), l))
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, time.Since(start))
+}
+
+func TestLimitReaderCancel(t *testing.T) {
+	l := NewLimiter(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := io.Copy(io.Discard, LimitReader(ctx, bytes.NewReader(make([]byte, 1024*1024)), l))
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestPutLimited(t *testing.T) {
+	p := NewProgress()
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar(""), Limiters: []*Limiter{NewLimiter(1024)}}
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	local, remote := RandName(tmpDir), RandName(tmpDir)
+	require.Nil(t, writeFile(local))
+	require.Nil(t, NewSCP(ssh, true).Put(ctx, local, remote))
+	assertSameFile(t, local, remote)
+}
@@ -0,0 +1,219 @@
+package scpw
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	remoteBackupSuffix = ".bak"
+	// remoteNewSuffix marks a target that did not exist before the PUT
+	remoteNewSuffix        = ".new"
+	remoteBackupTimeFormat = "20060102150405.000"
+	// remoteBackupOldFormat are the stamps of older versions, still rolled back
+	remoteBackupOldFormat = "20060102150405"
+)
+
+// RemoteBackup copies remote targets to `<name>.<stamp>.bak` before PUT overwrites them,
+// a missing target is recorded as an empty `<name>.<stamp>.new`. Every target of one
+// run shares the same stamp so they can be rolled back as a set.
+type RemoteBackup struct {
+	Dir   string
+	Stamp string
+}
+
+func NewRemoteBackup(dir string) RemoteBackup {
+	return RemoteBackup{Dir: dir, Stamp: time.Now().Format(remoteBackupTimeFormat)}
+}
+
+func (b RemoteBackup) dir(target string) string {
+	if b.Dir != "" {
+		return filepath.Clean(b.Dir)
+	}
+	return filepath.Dir(filepath.Clean(target))
+}
+
+func (b RemoteBackup) Name(target string) string {
+	return b.stampName(target, b.Stamp)
+}
+
+func (b RemoteBackup) stampName(target, stamp string) string {
+	return b.prefix(target) + stamp + remoteBackupSuffix
+}
+
+// newName is the marker of a target the PUT creates.
+func (b RemoteBackup) newName(target string) string {
+	return b.prefix(target) + b.Stamp + remoteNewSuffix
+}
+
+// prefix is what the backup names of target start with, the stamp follows.
+func (b RemoteBackup) prefix(target string) string {
+	return filepath.Join(b.dir(target), filepath.Base(filepath.Clean(target))) + "."
+}
+
+// PutTargets returns the remote paths a PUT of localPath to remotePath writes.
+func PutTargets(localPath, remotePath string) ([]string, error) {
+	excludeRootDir := strings.HasSuffix(localPath, "*")
+	localPath = strings.TrimSuffix(localPath, "*")
+	if excludeRootDir {
+		child, err := StatDirChild(localPath)
+		if err != nil {
+			return nil, err
+		}
+		targets := make([]string, 0, len(child))
+		for _, entry := range child {
+			targets = append(targets, filepath.Join(remotePath, entry.Name()))
+		}
+		return targets, nil
+	}
+	_, _, _, _, isDir, err := StatDirMeta(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if isDir {
+		return []string{filepath.Join(remotePath, filepath.Base(filepath.Clean(localPath)))}, nil
+	}
+	return []string{remotePath}, nil
+}
+
+// PutTargets returns the remote paths written by every lr-map entry of n.
+func (n *Node) PutTargets() ([]string, error) {
+	var targets []string
+	for _, lr := range n.LRMap {
+		t, err := PutTargets(lr.Local, lr.Remote)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t...)
+	}
+	return targets, nil
+}
+
+// BackupRemote copies the existing targets to their backup names and marks the
+// missing ones, a rollback removes them.
+func (scp *SCP) BackupRemote(b RemoteBackup, targets []string) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	cmds := make([]string, 0, len(targets)+1)
+	if b.Dir != "" {
+		cmds = append(cmds, fmt.Sprintf("mkdir -p %q", b.Dir))
+	}
+	for _, target := range targets {
+		cmds = append(cmds, fmt.Sprintf("if [ -e %[1]q ]; then cp -a %[1]q %[2]q; else : > %[3]q; fi", target, b.Name(target), b.newName(target)))
+	}
+	if out, err := scp.Exec(strings.Join(cmds, " && ")); err != nil {
+		return fmt.Errorf("backup remote failed! e: %v %s", err, out)
+	}
+	return nil
+}
+
+// RemoteBackupStamps returns the backup stamps of every target, newest first.
+func (scp *SCP) RemoteBackupStamps(b RemoteBackup, targets []string) (map[string][]string, error) {
+	backups, err := scp.remoteBackups(b, targets)
+	if err != nil {
+		return nil, err
+	}
+	stamps := make(map[string][]string, len(backups))
+	for target, names := range backups {
+		for stamp := range names {
+			stamps[target] = append(stamps[target], stamp)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(stamps[target])))
+	}
+	return stamps, nil
+}
+
+// remoteBackups returns the backups and the new target markers of every
+// target by stamp, a missing backup dir is an error.
+func (scp *SCP) remoteBackups(b RemoteBackup, targets []string) (map[string]map[string]string, error) {
+	var checks, cmds []string
+	dirs := map[string]bool{}
+	for _, target := range targets {
+		if dir := b.dir(target); !dirs[dir] {
+			dirs[dir] = true
+			checks = append(checks, fmt.Sprintf("[ -d %[1]q ] || { echo %[2]q; exit 1; }", dir, "remote backup dir:["+dir+"] not found"))
+		}
+		cmds = append(cmds, fmt.Sprintf("ls -1d %[1]q*%[2]s %[1]q*%[3]s 2>/dev/null", b.prefix(target), remoteBackupSuffix, remoteNewSuffix))
+	}
+	// ls fails when a target has no backup, the listing is still complete
+	checks = append(checks, "{ "+strings.Join(cmds, "; ")+"; true; }")
+	out, err := scp.Exec(strings.Join(checks, " && "))
+	if err != nil {
+		return nil, fmt.Errorf("list remote backups failed! e: %v %s", err, out)
+	}
+	backups := make(map[string]map[string]string, len(targets))
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		name := scanner.Text()
+		for _, target := range targets {
+			for _, suffix := range []string{remoteBackupSuffix, remoteNewSuffix} {
+				if !strings.HasPrefix(name, b.prefix(target)) || !strings.HasSuffix(name, suffix) {
+					continue
+				}
+				stamp := strings.TrimSuffix(strings.TrimPrefix(name, b.prefix(target)), suffix)
+				if !validStamp(stamp) {
+					continue
+				}
+				if backups[target] == nil {
+					backups[target] = map[string]string{}
+				}
+				backups[target][stamp] = name
+			}
+		}
+	}
+	return backups, nil
+}
+
+// validStamp reports whether stamp is the stamp of a backup set.
+func validStamp(stamp string) bool {
+	for _, format := range []string{remoteBackupTimeFormat, remoteBackupOldFormat} {
+		if _, err := time.Parse(format, stamp); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Rollback restores the targets from the most recent backup set and removes
+// the ones that set created, it returns the stamp of that set, the restored
+// and the removed targets.
+func (scp *SCP) Rollback(b RemoteBackup, targets []string) (string, []string, []string, error) {
+	backups, err := scp.remoteBackups(b, targets)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	latest := ""
+	for _, names := range backups {
+		for stamp := range names {
+			if stamp > latest {
+				latest = stamp
+			}
+		}
+	}
+	if latest == "" {
+		return "", nil, nil, fmt.Errorf("no remote backup found")
+	}
+	var restored, removed, cmds []string
+	for _, target := range targets {
+		name, ok := backups[target][latest]
+		switch {
+		case !ok:
+		case strings.HasSuffix(name, remoteNewSuffix):
+			cmds = append(cmds, fmt.Sprintf("rm -rf %q", target))
+			removed = append(removed, target)
+		default:
+			cmds = append(cmds, fmt.Sprintf("rm -rf %[1]q && cp -a %[2]q %[1]q", target, name))
+			restored = append(restored, target)
+		}
+	}
+	if out, err := scp.Exec(strings.Join(cmds, " && ")); err != nil {
+		return latest, nil, nil, fmt.Errorf("rollback remote failed! e: %v %s", err, out)
+	}
+	return latest, restored, removed, nil
+}
@@ -0,0 +1,102 @@
+package scpw
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoteBackupName(t *testing.T) {
+	b := RemoteBackup{Stamp: "20230102030405.123"}
+	assert.Equal(t, "/etc/nginx/nginx.conf.20230102030405.123.bak", b.Name("/etc/nginx/nginx.conf"))
+	assert.Equal(t, "/etc/nginx/nginx.conf.20230102030405.123.new", b.newName("/etc/nginx/nginx.conf"))
+	b.Dir = "/var/backup/"
+	assert.Equal(t, "/var/backup/conf.d.20230102030405.123.bak", b.Name("/etc/nginx/conf.d/"))
+	assert.Len(t, NewRemoteBackup("").Stamp, len(remoteBackupTimeFormat))
+}
+
+func TestPutTargets(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "a.conf")
+	require.Nil(t, writeFile(file))
+	require.Nil(t, mkdir(filepath.Join(root, "conf.d")))
+
+	targets, err := PutTargets(file, "/etc/b.conf")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"/etc/b.conf"}, targets)
+
+	targets, err = PutTargets(root, "/etc")
+	require.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join("/etc", filepath.Base(root))}, targets)
+
+	targets, err = PutTargets(root+"/*", "/etc")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"/etc/a.conf", "/etc/conf.d"}, targets)
+
+	_, err = PutTargets(filepath.Join(root, "not-exist"), "/etc")
+	assert.NotNil(t, err)
+
+	node := &Node{LRMap: []LRMap{{Local: file, Remote: "/etc/b.conf"}, {Local: root + "/*", Remote: "/etc"}}}
+	targets, err = node.PutTargets()
+	require.Nil(t, err)
+	assert.Len(t, targets, 3)
+}
+
+func TestBackupRemoteRollback(t *testing.T) {
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	target := RandName(tmpDir)
+	require.Nil(t, os.WriteFile(target, []byte("v1"), os.FileMode(0644)))
+	missing := RandName(tmpDir)
+	// a set of an older version, its stamp has seconds only
+	b := RemoteBackup{Dir: RandName(tmpDir), Stamp: "20230102030405"}
+	require.Nil(t, scpwCli.BackupRemote(b, []string{target, missing}))
+
+	// the PUT replaces target and creates missing
+	require.Nil(t, os.WriteFile(target, []byte("v2"), os.FileMode(0644)))
+	require.Nil(t, os.WriteFile(missing, []byte("new"), os.FileMode(0644)))
+	stamp, restored, removed, err := scpwCli.Rollback(RemoteBackup{Dir: b.Dir}, []string{target, missing})
+	require.Nil(t, err)
+	assert.Equal(t, b.Stamp, stamp)
+	assert.Equal(t, []string{target}, restored)
+	assert.Equal(t, []string{missing}, removed)
+	content, err := os.ReadFile(target)
+	require.Nil(t, err)
+	assert.Equal(t, "v1", string(content))
+	_, err = os.Stat(missing)
+	assert.True(t, os.IsNotExist(err))
+
+	// two sets of the same second are told apart
+	first := RemoteBackup{Dir: b.Dir, Stamp: "20240102030405.100"}
+	require.Nil(t, scpwCli.BackupRemote(first, []string{target}))
+	require.Nil(t, os.WriteFile(target, []byte("v3"), os.FileMode(0644)))
+	second := RemoteBackup{Dir: b.Dir, Stamp: "20240102030405.200"}
+	require.Nil(t, scpwCli.BackupRemote(second, []string{target}))
+	require.Nil(t, os.WriteFile(target, []byte("v4"), os.FileMode(0644)))
+	stamps, err := scpwCli.RemoteBackupStamps(RemoteBackup{Dir: b.Dir}, []string{target})
+	require.Nil(t, err)
+	assert.Equal(t, []string{second.Stamp, first.Stamp, b.Stamp}, stamps[target])
+	stamp, _, _, err = scpwCli.Rollback(RemoteBackup{Dir: b.Dir}, []string{target})
+	require.Nil(t, err)
+	assert.Equal(t, second.Stamp, stamp)
+	content, err = os.ReadFile(target)
+	require.Nil(t, err)
+	assert.Equal(t, "v3", string(content))
+
+	_, _, _, err = scpwCli.Rollback(RemoteBackup{}, []string{missing})
+	assert.NotNil(t, err)
+
+	// an unreachable backup dir is not the same as no backups
+	gone := RemoteBackup{Dir: filepath.Join(tmpDir, "not-exist")}
+	_, err = scpwCli.RemoteBackupStamps(gone, []string{target})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not found")
+	_, _, _, err = scpwCli.Rollback(gone, []string{target})
+	require.NotNil(t, err)
+	assert.NotContains(t, err.Error(), "no remote backup found")
+}
@@ -32,8 +32,51 @@ const (
 )
 
 type Context struct {
-	Ctx context.Context
-	Bar *mpb.Bar
+	Ctx    context.Context
+	Bar    *mpb.Bar
+	Verify VerifyType
+	Atomic bool
+	Backup Backup
+	// Limiters throttle the content of every file, shared with other transfers
+	Limiters []*Limiter
+	// Codec compresses the transfer, nil sends plain scp
+	Codec *Codec
+	// Chunks uploads a large file as that many concurrent ranges
+	Chunks int
+	// Tracker reports every file of the run, Bar is used without it
+	Tracker *Tracker
+}
+
+// copy moves size bytes of the file name from out to in and reports them to
+// the tracker, or to Bar without one.
+func (ctx Context) copy(name string, in io.Writer, out io.Reader, size int64) error {
+	if ctx.Tracker == nil {
+		return parseContent(ctx.Bar, in, out, size)
+	}
+	f := ctx.Tracker.Start(name, size)
+	_, err := io.CopyN(in, f.Reader(out), size)
+	f.Finish(err)
+	return err
+}
+
+// limit throttles r by the limiters and fails it once ctx is cancelled.
+func (ctx Context) limit(r io.Reader) io.Reader {
+	if ctx.Ctx != nil {
+		r = &cancelReader{ctx: ctx.Ctx, r: r}
+	}
+	return LimitReader(ctx.Ctx, r, ctx.Limiters...)
+}
+
+type cancelReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
 }
 
 type File struct {
@@ -105,6 +148,36 @@ type scpChan struct {
 	fileChan  chan File
 	exitChan  chan struct{}
 	closeChan chan struct{}
+	// stopped is closed when the sender returns, the walk stops with it
+	stopped chan struct{}
+}
+
+// errSenderStopped is returned to the walk once the sender failed, the
+// sender reports its own error.
+var errSenderStopped = errors.New("sender stopped")
+
+// send hands file to the sender unless ctx is cancelled or the sender stopped first.
+func (c *scpChan) send(ctx Context, file File) error {
+	select {
+	case c.fileChan <- file:
+		return nil
+	case <-c.stopped:
+		return errSenderStopped
+	case <-ctx.Ctx.Done():
+		return ctx.Ctx.Err()
+	}
+}
+
+// signal sends on ch unless ctx is cancelled or the sender stopped first.
+func (c *scpChan) signal(ctx Context, ch chan struct{}) error {
+	select {
+	case ch <- struct{}{}:
+		return nil
+	case <-c.stopped:
+		return errSenderStopped
+	case <-ctx.Ctx.Done():
+		return ctx.Ctx.Err()
+	}
 }
 
 type SCP struct {
@@ -128,7 +201,7 @@ func NewSSH(node *Node) (*ssh.Client, error) {
 		}
 		auth = append(auth, ssh.PublicKeys(privateKey))
 	} else {
-		auth = append(auth, ssh.Password(node.Password))
+		auth = append(auth, ssh.PasswordCallback(node.ResolvePassword))
 	}
 	config := &ssh.ClientConfig{
 		User: node.User,
@@ -155,7 +228,54 @@ func NewSCP(cli *ssh.Client, keepTime bool) *SCP {
 	}
 }
 
+// newSession opens a session which is closed as soon as ctx is cancelled, that
+// fails every pending read and write on it. stop releases the watcher.
+func (scp *SCP) newSession(ctx Context) (*ssh.Session, func(), error) {
+	session, err := scp.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ctx.Ctx == nil {
+		return session, func() {}, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Ctx.Done():
+			session.Close()
+		case <-done:
+		}
+	}()
+	return session, func() { close(done) }, nil
+}
+
+// Output runs cmd on the remote host and returns its standard output.
+func (scp *SCP) Output(cmd string) ([]byte, error) {
+	session, err := scp.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	return session.Output(cmd)
+}
+
+// Exec runs cmd on the remote host and returns its combined output.
+func (scp *SCP) Exec(cmd string) ([]byte, error) {
+	session, err := scp.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	return session.CombinedOutput(cmd)
+}
+
 func (scp *SCP) SwitchScpwFunc(ctx Context, localPath, remotePath string, typ SCPWType) (err error) {
+	defer func() {
+		// a cancelled transfer fails with whatever the closed session returned
+		if err != nil && ctx.Ctx != nil && ctx.Ctx.Err() != nil {
+			err = ctx.Ctx.Err()
+		}
+	}()
 	excludeRootDir := false
 	if typ == PUT {
 		if localPath[len(localPath)-1] == '*' {
@@ -185,43 +305,53 @@ func (scp *SCP) SwitchScpwFunc(ctx Context, localPath, remotePath string, typ SC
 				return err
 			}
 			if err = scp.GetAll(ctx, localTmp, remotePath); err == nil {
-				return scp.replaceDir(localTmp, localPath, remotePath)
+				return scp.replaceDir(ctx, localTmp, localPath, remotePath)
 			} else {
+				os.RemoveAll(localTmp)
 				return err
 			}
 		} else {
 			if err = scp.Get(ctx, localTmp, remotePath); err == nil {
-				return scp.replace(localTmp, localPath)
+				return scp.replace(ctx, localTmp, localPath)
 			} else {
+				os.Remove(localTmp)
 				return err
 			}
 		}
 	}
 }
 
-func (scp *SCP) replace(tmp, local string) error {
-	newTmp := filepath.Join(filepath.Dir(local), uuid.NewString())
-	if _, err := os.Stat(local); err == nil {
-		if err = os.Rename(local, newTmp); err != nil {
-			return err
+func (scp *SCP) replace(ctx Context, tmp, local string) error {
+	name, err := ctx.Backup.Save(local)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, local); err != nil {
+		if e := ctx.Backup.Restore(name, local); e != nil {
+			log.Errorf("restore [%s] from [%s] failed! e: %v", local, name, e)
 		}
+		return err
 	}
-	return os.Rename(tmp, local)
+	return ctx.Backup.Prune(local)
 }
 
-func (scp *SCP) replaceDir(tmp, local, remote string) error {
+func (scp *SCP) replaceDir(ctx Context, tmp, local, remote string) error {
 	dirname := filepath.Base(filepath.Clean(remote))
 	old := filepath.Join(local, dirname)
-	newTmp := filepath.Join(local, uuid.NewString())
-	if _, err := os.Stat(old); err == nil {
-		if err = os.Rename(old, newTmp); err != nil {
-			return err
+	name, err := ctx.Backup.Save(old)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(filepath.Join(tmp, dirname), old); err != nil {
+		if e := ctx.Backup.Restore(name, old); e != nil {
+			log.Errorf("restore [%s] from [%s] failed! e: %v", old, name, e)
 		}
+		return err
 	}
-	if err := os.Rename(filepath.Join(tmp, dirname), old); err != nil {
+	if err := os.RemoveAll(tmp); err != nil {
 		return err
 	}
-	return os.RemoveAll(tmp)
+	return ctx.Backup.Prune(old)
 }
 
 func (scp *SCP) PutAllExcludeRoot(ctx Context, srcPath, dstPath string) error {
@@ -245,13 +375,20 @@ func (scp *SCP) PutAllExcludeRoot(ctx Context, srcPath, dstPath string) error {
 }
 
 func (scp *SCP) PutAll(ctx Context, srcPath, dstPath string) error {
+	if ctx.Atomic {
+		return scp.putAllAtomic(ctx, srcPath, dstPath)
+	}
+	if ctx.Codec != nil {
+		return scp.putCompressed(ctx, srcPath, dstPath, filepath.Base(filepath.Clean(srcPath)))
+	}
 	wg := sync.WaitGroup{}
-	wg.Add(2)
-	session, err := scp.NewSession()
+	wg.Add(3)
+	session, stop, err := scp.newSession(ctx)
 	if err != nil {
 		return err
 	}
 	defer session.Close()
+	defer stop()
 	stdin, err := session.StdinPipe()
 	if err != nil {
 		return err
@@ -261,17 +398,23 @@ func (scp *SCP) PutAll(ctx Context, srcPath, dstPath string) error {
 		return err
 	}
 	errChan := make(chan error, 3)
-	scpCh := &scpChan{fileChan: make(chan File), exitChan: make(chan struct{}), closeChan: make(chan struct{})}
+	scpCh := &scpChan{fileChan: make(chan File), exitChan: make(chan struct{}), closeChan: make(chan struct{}), stopped: make(chan struct{})}
+	var sums []checksum
 	go func() {
-		if err = WalkTree(ctx, scpCh, srcPath, srcPath, dstPath); err != nil {
-			errChan <- err
-			return
+		defer wg.Done()
+		if err := WalkTree(ctx, scpCh, srcPath, srcPath, filepath.Join(dstPath, filepath.Base(srcPath))); err != nil {
+			if !errors.Is(err, errSenderStopped) {
+				errChan <- err
+			}
+			// the sender ends the upload with the walk
+			close(scpCh.closeChan)
 		}
 	}()
 
 	go func() {
-		defer stdin.Close()
 		defer wg.Done()
+		defer close(scpCh.stopped)
+		defer stdin.Close()
 	loop:
 		for {
 			select {
@@ -310,16 +453,28 @@ func (scp *SCP) PutAll(ctx Context, srcPath, dstPath string) error {
 				if !file.IsDir {
 					sizeNum, err1 := ParseInt64(size)
 					if err1 != nil {
-						errChan <- err
+						errChan <- err1
+						return
+					}
+					h, err1 := ctx.newHash()
+					if err1 != nil {
+						errChan <- err1
 						return
 					}
 					open, err1 := os.Open(file.LocalPath)
-					err1 = parseContent(ctx.Bar, stdin, open, sizeNum)
+					if err1 != nil {
+						errChan <- err1
+						return
+					}
+					err1 = ctx.copy(file.Name, stdin, ctx.limit(hashReader(open, h)), sizeNum)
 					open.Close()
 					if err1 != nil {
 						errChan <- err1
 						return
 					}
+					if h != nil {
+						sums = append(sums, checksum{remote: file.RemotePath, sum: sumOf(h)})
+					}
 
 					if _, err = fmt.Fprint(stdin, "\x00"); err != nil {
 						errChan <- err
@@ -346,6 +501,9 @@ func (scp *SCP) PutAll(ctx Context, srcPath, dstPath string) error {
 				}
 			case <-scpCh.closeChan:
 				break loop
+			case <-ctx.Ctx.Done():
+				errChan <- ctx.Ctx.Err()
+				return
 			}
 		}
 	}()
@@ -370,7 +528,7 @@ func (scp *SCP) PutAll(ctx Context, srcPath, dstPath string) error {
 			return err
 		}
 	}
-	return nil
+	return scp.verify(ctx.Verify, sums)
 }
 
 func WalkTree(ctx Context, scpChan *scpChan, rootParent, root, dstPath string) error {
@@ -382,15 +540,17 @@ func WalkTree(ctx Context, scpChan *scpChan, rootParent, root, dstPath string) e
 		if err != nil {
 			return err
 		}
-		scpChan.fileChan <- NewFile(name, root, dstPath, mode, atime, mtime, "0", true)
+		if err = scpChan.send(ctx, NewFile(name, root, dstPath, mode, atime, mtime, "0", true)); err != nil {
+			return err
+		}
 		var dirs []os.DirEntry
 		for _, obj := range child {
 			if !obj.IsDir() {
 				filePath := filepath.Join(root, obj.Name())
 				if cName, cMode, cSize, cAtime, cMtime, cErr := StatFile(filePath); cErr != nil {
 					return fmt.Errorf("WalkTree failed! root: %s e: %v", root, cErr)
-				} else {
-					scpChan.fileChan <- NewFile(cName, filePath, filepath.Join(dstPath, cName), cMode, cAtime, cMtime, cSize, false)
+				} else if err = scpChan.send(ctx, NewFile(cName, filePath, filepath.Join(dstPath, cName), cMode, cAtime, cMtime, cSize, false)); err != nil {
+					return err
 				}
 			} else {
 				dirs = append(dirs, obj)
@@ -405,9 +565,11 @@ func WalkTree(ctx Context, scpChan *scpChan, rootParent, root, dstPath string) e
 				return err
 			}
 		}
-		scpChan.exitChan <- struct{}{}
+		if err = scpChan.signal(ctx, scpChan.exitChan); err != nil {
+			return err
+		}
 		if rootParent == root {
-			scpChan.closeChan <- struct{}{}
+			return scpChan.signal(ctx, scpChan.closeChan)
 		}
 		return nil
 	}
@@ -421,6 +583,20 @@ func (scp *SCP) Put(ctx Context, srcPath, dstPath string) error {
 	if stat.IsDir() {
 		return errors.New(fmt.Sprintf("local:[%s] is dir", srcPath))
 	}
+	// chunks land in a temp file which is renamed, atomic anyway
+	if ctx.chunked(stat.Size()) {
+		return scp.putChunked(ctx, srcPath, dstPath, stat)
+	}
+	if ctx.Atomic {
+		return scp.putAtomic(ctx, srcPath, dstPath)
+	}
+	if ctx.Codec != nil {
+		dir, name, err := scp.putTarget(srcPath, dstPath)
+		if err != nil {
+			return err
+		}
+		return scp.putCompressed(ctx, srcPath, dir, name)
+	}
 	var atime, mtime string
 	if scp.KeepTime {
 		atime, mtime = StatTimeV2(stat)
@@ -433,16 +609,18 @@ func (scp *SCP) Put(ctx Context, srcPath, dstPath string) error {
 	if err != nil {
 		return err
 	}
+	defer open.Close()
 	return scp.put(ctx, dstPath, open, mode, stat.Size(), atime, mtime)
 }
 
 func (scp *SCP) put(ctx Context, dstPath string, in io.Reader, mode string, size int64, atime, mtime string) error {
 	wg := sync.WaitGroup{}
-	session, err := scp.NewSession()
+	session, stop, err := scp.newSession(ctx)
 	if err != nil {
 		return err
 	}
 	defer session.Close()
+	defer stop()
 	stdout, err := session.StdoutPipe()
 	if err != nil {
 		return err
@@ -454,6 +632,11 @@ func (scp *SCP) put(ctx Context, dstPath string, in io.Reader, mode string, size
 	errChan := make(chan error, 2)
 
 	fileName := filepath.Base(dstPath)
+	h, err := ctx.newHash()
+	if err != nil {
+		return err
+	}
+	in = hashReader(in, h)
 
 	wg.Add(2)
 	go func() {
@@ -488,7 +671,7 @@ func (scp *SCP) put(ctx Context, dstPath string, in io.Reader, mode string, size
 			return
 		}
 
-		_, err = io.Copy(stdin, in)
+		err = ctx.copy(fileName, stdin, ctx.limit(in), size)
 		if err != nil {
 			errChan <- err
 			return
@@ -530,15 +713,22 @@ func (scp *SCP) put(ctx Context, dstPath string, in io.Reader, mode string, size
 			return err
 		}
 	}
+	if h != nil {
+		return scp.verify(ctx.Verify, []checksum{{remote: dstPath, sum: sumOf(h)}})
+	}
 	return nil
 }
 
 func (scp *SCP) Get(ctx Context, srcPath, dstPath string) error {
-	session, err := scp.NewSession()
-	defer session.Close()
+	if ctx.Codec != nil {
+		return scp.getCompressed(ctx, dstPath, filepath.Dir(srcPath), filepath.Base(srcPath), false)
+	}
+	session, stop, err := scp.newSession(ctx)
 	if err != nil {
 		return err
 	}
+	defer session.Close()
+	defer stop()
 	wg := &sync.WaitGroup{}
 	errChan := make(chan error, 1)
 
@@ -599,12 +789,19 @@ func (scp *SCP) Get(ctx Context, srcPath, dstPath string) error {
 			return
 		}
 
+		h, err1 := ctx.newHash()
+		if err1 != nil {
+			errChan <- err1
+			return
+		}
+
 		// create file
 		in, err1 := os.Create(srcPath)
 		if err1 != nil {
 			errChan <- err1
 			return
 		}
+		defer in.Close()
 
 		if err = os.Chmod(srcPath, attr.Mode); err != nil {
 			os.Remove(srcPath)
@@ -612,6 +809,13 @@ func (scp *SCP) Get(ctx Context, srcPath, dstPath string) error {
 			return
 		}
 
+		if err = ctx.copy(attr.Name, hashWriter(in, h), ctx.limit(stdout), attr.Size); err != nil {
+			os.Remove(srcPath)
+			errChan <- err
+			return
+		}
+
+		// writing the content updates the mtime, set the times afterwards
 		if scp.KeepTime {
 			err = os.Chtimes(srcPath, attr.Atime, attr.Mtime)
 			if err != nil {
@@ -621,12 +825,6 @@ func (scp *SCP) Get(ctx Context, srcPath, dstPath string) error {
 			}
 		}
 
-		if err = parseContent(ctx.Bar, in, stdout, attr.Size); err != nil {
-			os.Remove(srcPath)
-			errChan <- err
-			return
-		}
-
 		if err = ack(stdin); err != nil {
 			os.Remove(srcPath)
 			errChan <- err
@@ -645,6 +843,14 @@ func (scp *SCP) Get(ctx Context, srcPath, dstPath string) error {
 			os.Remove(srcPath)
 			return
 		}
+
+		if h != nil {
+			if err = scp.verify(ctx.Verify, []checksum{{remote: dstPath, sum: sumOf(h)}}); err != nil {
+				os.Remove(srcPath)
+				errChan <- err
+				return
+			}
+		}
 		//fmt.Printf("    file:[%40s] size:[%15d]\n", filepath.Base(srcPath), attr.Size)
 	}()
 	wg.Wait()
@@ -658,10 +864,15 @@ func (scp *SCP) Get(ctx Context, srcPath, dstPath string) error {
 }
 
 func (scp *SCP) GetAll(ctx Context, localPath, remotePath string) error {
-	session, err := scp.NewSession()
+	if ctx.Codec != nil {
+		return scp.getCompressed(ctx, remotePath, localPath, filepath.Base(filepath.Clean(remotePath)), true)
+	}
+	session, stop, err := scp.newSession(ctx)
 	if err != nil {
 		return err
 	}
+	defer session.Close()
+	defer stop()
 	wg := &sync.WaitGroup{}
 	errChan := make(chan error, 2)
 
@@ -693,6 +904,9 @@ func (scp *SCP) GetAll(ctx Context, localPath, remotePath string) error {
 			return
 		}
 
+		var sums []checksum
+		// dir times are set on E, creating children updates the mtime
+		var dirs []Attr
 		curLocal, curRemote := localPath, filepath.Dir(filepath.Clean(remotePath))
 		for {
 			var attr Attr
@@ -746,9 +960,20 @@ func (scp *SCP) GetAll(ctx Context, localPath, remotePath string) error {
 					errChan <- e
 					return
 				}
+				dirs = append(dirs, attr)
 				//fmt.Printf("    file:[%40s] size:[%15d]\n", attr.Name, attr.Size)
 
 			} else if attr.Typ == E {
+				if len(dirs) > 0 {
+					dir := dirs[len(dirs)-1]
+					dirs = dirs[:len(dirs)-1]
+					if scp.KeepTime {
+						if e = os.Chtimes(curLocal, dir.Atime, dir.Mtime); e != nil {
+							errChan <- e
+							return
+						}
+					}
+				}
 				// cd ../
 				curLocal = filepath.Dir(filepath.Clean(curLocal))
 				curRemote = filepath.Dir(filepath.Clean(curRemote))
@@ -758,19 +983,29 @@ func (scp *SCP) GetAll(ctx Context, localPath, remotePath string) error {
 				return
 			}
 
-			if scp.KeepTime && attr.Typ != E {
-				if e = os.Chtimes(curLocal, attr.Atime, attr.Mtime); e != nil {
-					os.Remove(curLocal)
+			if attr.Typ == C {
+				h, e := ctx.newHash()
+				if e != nil {
 					errChan <- e
 					return
 				}
-			}
-			if attr.Typ == C {
-				if e = parseContent(ctx.Bar, in, stdout, attr.Size); e != nil {
+				e = ctx.copy(attr.Name, hashWriter(in, h), ctx.limit(stdout), attr.Size)
+				in.Close()
+				if e != nil {
 					os.Remove(curLocal)
 					errChan <- e
 					return
 				}
+				if scp.KeepTime {
+					if e = os.Chtimes(curLocal, attr.Atime, attr.Mtime); e != nil {
+						os.Remove(curLocal)
+						errChan <- e
+						return
+					}
+				}
+				if h != nil {
+					sums = append(sums, checksum{remote: curRemote, sum: sumOf(h)})
+				}
 
 				if e = ack(stdin); e != nil {
 					os.Remove(curLocal)
@@ -793,6 +1028,11 @@ func (scp *SCP) GetAll(ctx Context, localPath, remotePath string) error {
 			errChan <- e
 			return
 		}
+
+		if e = scp.verify(ctx.Verify, sums); e != nil {
+			errChan <- e
+			return
+		}
 	}()
 	wg.Wait()
 	close(errChan)
@@ -832,16 +1072,22 @@ func ack(in io.Writer) error {
 	return nil
 }
 
+// parseMeta reads one C, D, E or T record. serve reads the records of any
+// client, a malformed one is an error.
 func parseMeta(out io.Reader, attr *Attr) error {
 	bufferedReader := bufio.NewReader(out)
 	message, err := bufferedReader.ReadString('\n')
 	if err != nil {
 		return err
 	}
-	message = strings.ReplaceAll(message, "\n", "")
-	parts := strings.Split(message, " ")
+	message = strings.TrimSuffix(message, "\n")
 	attr.Typ = parseCommandType(message)
 	if attr.Typ == C || attr.Typ == D {
+		// C<mode> <size> <name>, the name may contain spaces
+		parts := strings.SplitN(message, " ", 3)
+		if len(parts) != 3 || parts[2] == "" {
+			return fmt.Errorf("invalid %s message:[%s]", attr.Typ, message)
+		}
 		err = attr.SetMode(parts[0][1:])
 		if err != nil {
 			return err
@@ -854,7 +1100,12 @@ func parseMeta(out io.Reader, attr *Attr) error {
 	} else if attr.Typ == E {
 
 	} else if attr.Typ == T {
-		err = attr.SetTime(parts[0][1:], parts[2])
+		// T<mtime> 0 <atime> 0
+		parts := strings.Split(message, " ")
+		if len(parts) != 4 {
+			return fmt.Errorf("invalid %s message:[%s]", attr.Typ, message)
+		}
+		err = attr.SetTime(parts[2], parts[0][1:])
 		if err != nil {
 			return err
 		}
@@ -865,6 +1116,9 @@ func parseMeta(out io.Reader, attr *Attr) error {
 }
 
 func parseCommandType(s string) CommandType {
+	if s == "" {
+		return NULL
+	}
 	b := s[0]
 	if b == 'T' {
 		return T
@@ -886,8 +1140,10 @@ func parseContent(bar *mpb.Bar, in io.Writer, out io.Reader, size int64) error {
 			return err
 		} else {
 			read += readN
-			bar.IncrBy(int(readN))
-			bar.SetTotal(bar.Current()+readN, false)
+			if bar != nil {
+				bar.IncrBy(int(readN))
+				bar.SetTotal(bar.Current()+readN, false)
+			}
 		}
 	}
 	return nil
@@ -3,21 +3,76 @@ package scpw
 import (
 	"bytes"
 	"context"
+	"github.com/T-TRz879/scpw/internal/scpwtest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 var (
-	testNode         = &Node{Host: "127.0.0.1", Port: "22", User: "scpwuser", Password: "scpwuser123"}
-	baseLocalDir     = "/tmp/scpw-local-dir"
-	baseRemoteDir    = "/tmp/scpw-remote-dir"
-	noPermissionDir  = "/tmp/no-permission-dir"
-	noPermissionFile = "/tmp/no-permission-file"
+	testNode         *Node
+	testServer       *scpwtest.Server
+	tmpDir           string
+	baseLocalDir     string
+	baseRemoteDir    string
+	noPermissionDir  string
+	noPermissionFile string
 )
 
+// TestMain serves the scp tests from an in-process SSH server, every path
+// lives under one temp dir that is removed afterwards.
+func TestMain(m *testing.M) {
+	root, err := os.MkdirTemp("", "scpw-test")
+	if err != nil {
+		panic(err)
+	}
+	testServer, err = scpwtest.NewServer(root, "scpwuser", "scpwuser123")
+	if err != nil {
+		panic(err)
+	}
+	testNode = &Node{Host: testServer.Host, Port: testServer.Port, User: testServer.User, Password: testServer.Password}
+	if err = setupTestDirs(root); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	testServer.Close()
+	os.Chmod(noPermissionDir, os.FileMode(0755))
+	os.RemoveAll(root)
+	os.Exit(code)
+}
+
+func setupTestDirs(root string) error {
+	tmpDir = filepath.Join(root, "tmp")
+	baseLocalDir = filepath.Join(root, "scpw-local-dir")
+	baseRemoteDir = filepath.Join(root, "scpw-remote-dir")
+	noPermissionDir = filepath.Join(root, "no-permission-dir")
+	noPermissionFile = filepath.Join(root, "no-permission-file")
+	for _, dir := range []string{tmpDir, baseLocalDir, baseRemoteDir, filepath.Join(baseLocalDir, "child"), noPermissionDir} {
+		if err := mkdir(dir); err != nil {
+			return err
+		}
+	}
+	for _, file := range []string{filepath.Join(baseLocalDir, "a"), filepath.Join(baseLocalDir, "child", "b"), filepath.Join(baseRemoteDir, "c"), noPermissionFile} {
+		if err := writeFile(file); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(noPermissionFile, os.FileMode(0)); err != nil {
+		return err
+	}
+	return os.Chmod(noPermissionDir, os.FileMode(0555))
+}
+
+// skipIfRoot skips permission tests, root is never denied.
+func skipIfRoot(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks do not apply to root")
+	}
+}
+
 func writeFile(name string) error {
 	_, err := os.Create(name)
 	if err != nil {
@@ -34,6 +89,20 @@ func mkdir(name string) error {
 	return os.Chmod(name, os.FileMode(0777)|os.FileMode(02))
 }
 
+func assertSameFile(t *testing.T, expected, actual string) {
+	want, err := os.ReadFile(expected)
+	require.Nil(t, err)
+	got, err := os.ReadFile(actual)
+	require.Nil(t, err)
+	assert.Equal(t, want, got)
+	wantStat, err := os.Stat(expected)
+	require.Nil(t, err)
+	gotStat, err := os.Stat(actual)
+	require.Nil(t, err)
+	assert.Equal(t, wantStat.Mode(), gotStat.Mode())
+	assert.Equal(t, wantStat.ModTime().Unix(), gotStat.ModTime().Unix())
+}
+
 func TestAttr(t *testing.T) {
 	attr := Attr{}
 
@@ -53,19 +122,20 @@ func TestAttr(t *testing.T) {
 func TestPutFile(t *testing.T) {
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local, remote := RandName(baseLocalDir), RandName("/tmp")
+	local, remote := RandName(baseLocalDir), RandName(tmpDir)
 	assert.Nil(t, writeFile(local))
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
 	err = scpwCli.Put(context, local, remote)
 	assert.Nil(t, err)
+	assertSameFile(t, local, remote)
 }
 
 func TestPutFileRemoteNotExist(t *testing.T) {
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local, remote := filepath.Join(baseLocalDir, "not-exist"), RandName("/tmp")
+	local, remote := filepath.Join(baseLocalDir, "not-exist"), RandName(tmpDir)
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
@@ -74,9 +144,10 @@ func TestPutFileRemoteNotExist(t *testing.T) {
 }
 
 func TestPutFileLocalPermissionDeny(t *testing.T) {
+	skipIfRoot(t)
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local, remote := noPermissionFile, RandName("/tmp")
+	local, remote := noPermissionFile, RandName(tmpDir)
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
@@ -85,6 +156,7 @@ func TestPutFileLocalPermissionDeny(t *testing.T) {
 }
 
 func TestPutFileRemotePermissionDeny(t *testing.T) {
+	skipIfRoot(t)
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
 	local, remote := RandName(baseRemoteDir), RandName(noPermissionDir)
@@ -99,7 +171,7 @@ func TestPutFileRemotePermissionDeny(t *testing.T) {
 func TestPutFileLocalIsDir(t *testing.T) {
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local, remote := baseLocalDir, RandName("/tmp")
+	local, remote := baseLocalDir, RandName(tmpDir)
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
@@ -110,31 +182,47 @@ func TestPutFileLocalIsDir(t *testing.T) {
 func TestPutAll(t *testing.T) {
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local, remote := baseLocalDir, RandName("/tmp")
+	local, remote := baseLocalDir, RandName(tmpDir)
 	assert.Nil(t, mkdir(remote))
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
 	err = scpwCli.PutAll(context, local, remote)
 	assert.Nil(t, err)
+	assertSameFile(t, filepath.Join(local, "child", "b"), filepath.Join(remote, filepath.Base(local), "child", "b"))
+}
+
+func TestPutAllRemoteNotExist(t *testing.T) {
+	p := NewProgress()
+	ctx, cancel := context.WithCancel(context.Background())
+	scpwCtx := Context{Ctx: ctx, Bar: p.NewInfiniteByesBar("")}
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+	// the walk stops with the failed sender, a later cancel finds nothing running
+	assert.NotNil(t, scpwCli.PutAll(scpwCtx, baseLocalDir, filepath.Join(tmpDir, "not-exist", "dir")))
+	cancel()
+	time.Sleep(50 * time.Millisecond)
 }
 
 func TestGetFile(t *testing.T) {
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local, remote := RandName("/tmp"), RandName(baseRemoteDir)
+	local, remote := RandName(tmpDir), RandName(baseRemoteDir)
 	assert.Nil(t, writeFile(remote))
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
 	err = scpwCli.Get(context, local, remote)
 	assert.Nil(t, err)
+	assertSameFile(t, remote, local)
 }
 
 func TestGetFileNotExist(t *testing.T) {
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local, remote := RandName("/tmp"), RandName(baseRemoteDir)
+	local, remote := RandName(tmpDir), RandName(baseRemoteDir)
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
@@ -143,10 +231,11 @@ func TestGetFileNotExist(t *testing.T) {
 }
 
 func TestGetFilePermissionDeny(t *testing.T) {
+	skipIfRoot(t)
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
 	// SSH login user does not have remote permission
-	local, remote := RandName("/tmp"), noPermissionFile
+	local, remote := RandName(tmpDir), noPermissionFile
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
@@ -157,7 +246,7 @@ func TestGetFilePermissionDeny(t *testing.T) {
 func TestGetFileRemoteIsDir(t *testing.T) {
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local, remote := RandName("/tmp"), baseLocalDir
+	local, remote := RandName(tmpDir), baseLocalDir
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
@@ -168,7 +257,7 @@ func TestGetFileRemoteIsDir(t *testing.T) {
 func TestGetAll(t *testing.T) {
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local := RandName("/tmp")
+	local := RandName(tmpDir)
 	assert.Nil(t, mkdir(local))
 	remote := baseLocalDir
 	ssh, err := NewSSH(testNode)
@@ -176,40 +265,41 @@ func TestGetAll(t *testing.T) {
 	scpwCli := NewSCP(ssh, true)
 	err = scpwCli.GetAll(context, local, remote)
 	assert.Nil(t, err)
+	assertSameFile(t, filepath.Join(remote, "child", "b"), filepath.Join(local, filepath.Base(remote), "child", "b"))
 }
 
 func TestPutSwitchScpwFunc(t *testing.T) {
 	// put file
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local := RandName("/tmp")
+	local := RandName(tmpDir)
 	assert.Nil(t, writeFile(local))
-	remote := RandName("/tmp")
+	remote := RandName(tmpDir)
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
 	scpwCli := NewSCP(ssh, true)
 	err = scpwCli.SwitchScpwFunc(context, local, remote, PUT)
 	assert.Nil(t, err)
 
-	local = RandName("/tmp")
+	local = RandName(tmpDir)
 	assert.Nil(t, mkdir(local))
 	assert.Nil(t, writeFile(RandName(local)))
 	assert.Nil(t, writeFile(RandName(local)))
-	remote = RandName("/tmp")
+	remote = RandName(tmpDir)
 	assert.Nil(t, mkdir(remote))
 	// put dir all
 	err = scpwCli.SwitchScpwFunc(context, local, remote, PUT)
 	assert.Nil(t, err)
 
 	// put dir exclude root
-	remote = RandName("/tmp")
+	remote = RandName(tmpDir)
 	assert.Nil(t, mkdir(remote))
 	err = scpwCli.SwitchScpwFunc(context, local+"/*", remote, PUT)
 	assert.Nil(t, err)
 
 	// put file permission deny
-	local = "/tmp/notexist"
-	remote = RandName("/tmp")
+	local = filepath.Join(tmpDir, "notexist")
+	remote = RandName(tmpDir)
 	err = scpwCli.SwitchScpwFunc(context, local, remote, PUT)
 	assert.NotNil(t, err)
 }
@@ -218,9 +308,9 @@ func TestGetSwitchScpwFunc(t *testing.T) {
 	// get file
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
-	local := RandName("/tmp")
+	local := RandName(tmpDir)
 	assert.Nil(t, mkdir(local))
-	remote := RandName("/tmp")
+	remote := RandName(tmpDir)
 	assert.Nil(t, writeFile(remote))
 	ssh, err := NewSSH(testNode)
 	assert.Nil(t, err)
@@ -229,12 +319,13 @@ func TestGetSwitchScpwFunc(t *testing.T) {
 	assert.Nil(t, err)
 
 	// get dir all
-	local = RandName("/tmp")
+	local = RandName(tmpDir)
 	assert.Nil(t, mkdir(local))
 	remote = baseRemoteDir
 	err = scpwCli.SwitchScpwFunc(context, local, remote+"/", GET)
 	assert.Nil(t, err)
 
+	skipIfRoot(t)
 	// get file local permission deny
 	local = noPermissionDir + "/"
 	remote = baseRemoteDir + "/"
@@ -242,12 +333,52 @@ func TestGetSwitchScpwFunc(t *testing.T) {
 	assert.NotNil(t, err)
 
 	// get file remote permission deny
-	local = RandName("/tmp")
+	local = RandName(tmpDir)
 	remote = noPermissionFile
 	err = scpwCli.SwitchScpwFunc(context, local, remote, GET)
 	assert.NotNil(t, err)
 }
 
+func TestCancelSwitchScpwFunc(t *testing.T) {
+	p := NewProgress()
+	content := make([]byte, 1024*1024)
+	big := RandName(tmpDir)
+	require.Nil(t, os.WriteFile(big, content, 0644))
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	for _, typ := range []SCPWType{PUT, GET} {
+		dir := RandName(tmpDir)
+		require.Nil(t, mkdir(dir))
+		local, remote := big, filepath.Join(dir, "big")
+		if typ == GET {
+			local, remote = filepath.Join(dir, "big"), big
+		}
+		cancelCtx, cancel := context.WithCancel(context.Background())
+		ctx := Context{Ctx: cancelCtx, Bar: p.NewInfiniteByesBar(""), Limiters: []*Limiter{NewLimiter(64)}}
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		err = scpwCli.SwitchScpwFunc(ctx, local, remote, typ)
+		assert.ErrorIs(t, err, context.Canceled, typ)
+		assert.Less(t, time.Since(start), 5*time.Second, typ)
+		if typ == GET {
+			// the uuid temp is removed
+			entries, err := os.ReadDir(dir)
+			require.Nil(t, err)
+			assert.Empty(t, entries)
+		}
+		cancel()
+	}
+
+	// the connection is still usable
+	local := RandName(tmpDir)
+	require.Nil(t, writeFile(local))
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
+	assert.Nil(t, scpwCli.Put(ctx, local, RandName(tmpDir)))
+}
+
 func TestWalkTree(t *testing.T) {
 	p := NewProgress()
 	context := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
@@ -296,3 +427,21 @@ func TestParseContent(t *testing.T) {
 	// EOF
 	assert.NotNil(t, parseContent(p.NewInfiniteByesBar(""), in, out, int64(5)))
 }
+
+func TestParseMetaTime(t *testing.T) {
+	// T<mtime> 0 <atime> 0, as OpenSSH sends it
+	attr := Attr{}
+	require.Nil(t, parseMeta(bytes.NewBufferString("T1446425372 0 1446425371 0\n"), &attr))
+	assert.Equal(t, T, attr.Typ)
+	assert.Equal(t, int64(1446425372), attr.Mtime.Unix())
+	assert.Equal(t, int64(1446425371), attr.Atime.Unix())
+}
+
+func TestParseMetaMalformed(t *testing.T) {
+	attr := Attr{}
+	require.Nil(t, parseMeta(bytes.NewBufferString("C0644 5 a  b\n"), &attr))
+	assert.Equal(t, "a  b", attr.Name)
+	for _, line := range []string{"\n", "C0644 5\n", "C0644\n", "D0755 0 \n", "T1446425372 0\n", "X\n"} {
+		assert.NotNil(t, parseMeta(bytes.NewBufferString(line), &Attr{}), line)
+	}
+}
@@ -0,0 +1,150 @@
+package scpw
+
+import (
+	"fmt"
+	"golang.org/x/term"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SecretResolver looks up a secret by key, `password-secret: <scheme>:<key>`
+// asks the resolver registered for scheme.
+type SecretResolver interface {
+	Resolve(key string) (string, error)
+}
+
+// DefaultVault resolves `password-secret: vault:<key>`.
+var DefaultVault = &Vault{}
+
+var (
+	resolversMu sync.Mutex
+	resolvers   = map[string]SecretResolver{"vault": DefaultVault}
+)
+
+// RegisterSecretResolver makes r resolve the secrets of scheme, it replaces
+// the resolver registered before.
+func RegisterSecretResolver(scheme string, r SecretResolver) {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	resolvers[scheme] = r
+}
+
+// SecretSchemes returns the schemes with a registered resolver, sorted.
+func SecretSchemes() []string {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	var schemes []string
+	for scheme := range resolvers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// ResolveSecret resolves a `<scheme>:<key>` reference.
+func ResolveSecret(ref string) (string, error) {
+	scheme, key, ok := strings.Cut(ref, ":")
+	resolversMu.Lock()
+	r := resolvers[scheme]
+	resolversMu.Unlock()
+	if !ok || r == nil {
+		return "", fmt.Errorf("invalid secret:[%s], expect <%s>:<key>", ref, strings.Join(SecretSchemes(), "|"))
+	}
+	return r.Resolve(key)
+}
+
+var (
+	// secretsMu also serializes the resolving, so concurrent dials of a node
+	// run its password-cmd or ask for a passphrase only once
+	secretsMu sync.Mutex
+	// secrets are the resolved passwords by source
+	secrets = map[string]string{}
+)
+
+// ResolvePassword returns the password of n from the source it sets, one of
+// password, password-env, password-cmd and password-secret. NewSSH calls it
+// only when the server asks for a password, the result is cached.
+func (n *Node) ResolvePassword() (string, error) {
+	var source string
+	switch {
+	case n.Password != "":
+		return n.Password, nil
+	case n.PasswordEnv != "":
+		source = "env:" + n.PasswordEnv
+	case n.PasswordCmd != "":
+		source = "cmd:" + n.PasswordCmd
+	case n.PasswordSecret != "":
+		source = "secret:" + n.PasswordSecret
+	default:
+		return "", nil
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if password, ok := secrets[source]; ok {
+		return password, nil
+	}
+	var password string
+	var err error
+	switch {
+	case n.PasswordEnv != "":
+		var ok bool
+		if password, ok = os.LookupEnv(n.PasswordEnv); !ok {
+			err = fmt.Errorf("environment variable %s is not set", n.PasswordEnv)
+		}
+	case n.PasswordCmd != "":
+		password, err = passwordCmd(n.PasswordCmd)
+	default:
+		password, err = ResolveSecret(n.PasswordSecret)
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolve password of node:[%s] failed! e: %v", n.Name, err)
+	}
+	secrets[source] = password
+	return password, nil
+}
+
+// passwordCmd runs cmd in the local shell and returns the first line of its
+// output. It keeps the terminal, a command like `pass` may ask for a passphrase.
+func passwordCmd(cmd string) (string, error) {
+	c := ShellCommand(cmd)
+	c.Stdin, c.Stderr = os.Stdin, os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("password-cmd:[%s] failed! e: %v", cmd, err)
+	}
+	password, _, _ := strings.Cut(string(out), "\n")
+	password = strings.TrimSuffix(password, "\r")
+	if password == "" {
+		return "", fmt.Errorf("password-cmd:[%s] printed nothing", cmd)
+	}
+	return password, nil
+}
+
+// ReadPassphrase asks for a passphrase on the terminal without echo, confirm
+// asks twice.
+func ReadPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("cannot ask for a passphrase, stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "again: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(pass) {
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+	return pass, nil
+}
@@ -0,0 +1,85 @@
+package scpw
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type mapResolver map[string]string
+
+func (m mapResolver) Resolve(key string) (string, error) {
+	if secret, ok := m[key]; ok {
+		return secret, nil
+	}
+	return "", fmt.Errorf("secret:[%s] not found", key)
+}
+
+func TestResolvePassword(t *testing.T) {
+	RegisterSecretResolver("test", mapResolver{"web": "from-resolver"})
+	defer delete(resolvers, "test")
+	t.Setenv("SCPW_TEST_PASSWORD", "from-env")
+	runs := filepath.Join(t.TempDir(), "runs")
+	for _, c := range []struct {
+		node     Node
+		password string
+	}{
+		{Node{}, ""},
+		{Node{Password: "literal"}, "literal"},
+		{Node{PasswordEnv: "SCPW_TEST_PASSWORD"}, "from-env"},
+		{Node{PasswordCmd: "echo from-cmd >> " + runs + "; echo from-cmd; echo second line"}, "from-cmd"},
+		{Node{PasswordSecret: "test:web"}, "from-resolver"},
+	} {
+		password, err := c.node.ResolvePassword()
+		assert.Nil(t, err)
+		assert.Equal(t, c.password, password)
+	}
+	// the command runs once however often the node dials
+	node := &Node{PasswordCmd: "echo from-cmd >> " + runs + "; echo from-cmd; echo second line"}
+	password, err := node.ResolvePassword()
+	assert.Nil(t, err)
+	assert.Equal(t, "from-cmd", password)
+	b, err := os.ReadFile(runs)
+	require.Nil(t, err)
+	assert.Equal(t, "from-cmd\n", string(b))
+
+	for _, node := range []*Node{
+		{PasswordEnv: "SCPW_TEST_MISSING"},
+		{PasswordCmd: "exit 1"},
+		{PasswordCmd: "true"},
+		{PasswordSecret: "test:db"},
+		{PasswordSecret: "nope:web"},
+	} {
+		_, err = node.ResolvePassword()
+		assert.NotNil(t, err, node)
+	}
+}
+
+func TestNewSSHPasswordCmd(t *testing.T) {
+	node := *testNode
+	node.Password, node.PasswordCmd = "", "echo "+testNode.Password
+	ssh, err := NewSSH(&node)
+	require.Nil(t, err)
+	ssh.Close()
+
+	node.PasswordCmd = "echo wrong"
+	_, err = NewSSH(&node)
+	assert.NotNil(t, err)
+}
+
+func TestInheritAuth(t *testing.T) {
+	nodes := []*Node{{Name: "group", PasswordCmd: "pass show group", Children: []*Node{
+		{Name: "a"},
+		{Name: "b", KeyPath: "/home/me/.ssh/id_ed25519"},
+		{Name: "c", Password: "123"},
+	}}}
+	inherit(nodes, nil, nil)
+	a, b, c := nodes[0].Children[0], nodes[0].Children[1], nodes[0].Children[2]
+	assert.Equal(t, "pass show group", a.PasswordCmd)
+	assert.Equal(t, "", b.PasswordCmd)
+	assert.Equal(t, "", c.PasswordCmd)
+	assert.Equal(t, "123", c.Password)
+}
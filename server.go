@@ -0,0 +1,550 @@
+package scpw
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type ServeMode = string
+
+const (
+	ServeReadWrite ServeMode = "rw"
+	ServeReadOnly  ServeMode = "ro"
+	ServeWriteOnly ServeMode = "wo"
+)
+
+type ServerConfig struct {
+	// Root is the directory exposed to clients, remote paths resolve inside it
+	Root string
+	// AuthorizedKeys is an OpenSSH authorized_keys file
+	AuthorizedKeys string
+	// HostKey is a private key file, an ephemeral key is generated when empty
+	HostKey string
+	// Mode is rw, ro (only `scp -f`) or wo (only `scp -t`)
+	Mode ServeMode
+}
+
+// Server is a minimal SSH server exposing Root through the scp sink/source
+// protocol, no other command is allowed.
+type Server struct {
+	ServerConfig
+	config *ssh.ServerConfig
+	wg     sync.WaitGroup
+	// mu guards listener and closed, Close may run before Serve got the listener
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+func NewServer(cfg ServerConfig) (*Server, error) {
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ServeReadWrite
+	case ServeReadWrite, ServeReadOnly, ServeWriteOnly:
+	default:
+		return nil, fmt.Errorf("invalid serve mode:[%s]", cfg.Mode)
+	}
+	root, err := filepath.Abs(cfg.Root)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	cfg.Root = root
+
+	keys, err := loadAuthorizedKeys(cfg.AuthorizedKeys)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, ok := keys[string(key.Marshal())]; ok {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %q", conn.User())
+		},
+	}
+	signer, err := loadHostKey(cfg.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(signer)
+	return &Server{ServerConfig: cfg, config: config}, nil
+}
+
+func loadAuthorizedKeys(name string) (map[string]struct{}, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]struct{})
+	for len(bytes.TrimSpace(b)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse authorized keys:[%s] failed! e: %v", name, err)
+		}
+		keys[string(key.Marshal())] = struct{}{}
+		b = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key in authorized keys:[%s]", name)
+	}
+	return keys, nil
+}
+
+func loadHostKey(name string) (ssh.Signer, error) {
+	if name == "" {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		log.Warnf("no host key given, using ephemeral key %s", ssh.FingerprintSHA256(signer.PublicKey()))
+		return signer, nil
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+// ListenAndServe listens on addr and serves until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return listener.Close()
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	log.Infof("serving %s (%s) on %s", s.Root, s.Mode, listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.wg.Wait()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.Warnf("handshake with %s failed! e: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(sconn.User(), ch, requests)
+	}
+}
+
+func (s *Server) handleSession(user string, ch ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go func() {
+			status := uint32(0)
+			if err := s.exec(ch, payload.Command); err != nil {
+				log.Warnf("user:[%s] cmd:[%s] failed! e: %v", user, payload.Command, err)
+				status = 1
+			} else {
+				log.Infof("user:[%s] cmd:[%s] done", user, payload.Command)
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			ch.Close()
+		}()
+	}
+}
+
+type serveCommand struct {
+	sink      bool
+	source    bool
+	recursive bool
+	keepTime  bool
+	path      string
+}
+
+// parseServeCommand parses `scp -[rtfpdv] [--] path`, the path may be quoted.
+// The path is the rest of the command as sent, its spaces are kept.
+func parseServeCommand(command string) (serveCommand, error) {
+	var cmd serveCommand
+	rest := strings.TrimLeft(command, " ")
+	next := func() string {
+		word, r, _ := strings.Cut(rest, " ")
+		rest = strings.TrimLeft(r, " ")
+		return word
+	}
+	if next() != "scp" || rest == "" {
+		return cmd, fmt.Errorf("only scp is supported")
+	}
+	for strings.HasPrefix(rest, "-") {
+		option := next()
+		if option == "--" {
+			break
+		}
+		for _, flag := range option[1:] {
+			switch flag {
+			case 't':
+				cmd.sink = true
+			case 'f':
+				cmd.source = true
+			case 'r':
+				cmd.recursive = true
+			case 'p':
+				cmd.keepTime = true
+			case 'd', 'v':
+			default:
+				return cmd, fmt.Errorf("unknown option -%c", flag)
+			}
+		}
+	}
+	if cmd.sink == cmd.source {
+		return cmd, fmt.Errorf("exactly one of -t and -f is required")
+	}
+	path := strings.TrimSpace(rest)
+	if unquoted, err := strconv.Unquote(path); err == nil {
+		path = unquoted
+	} else if len(path) > 1 && path[0] == '\'' && path[len(path)-1] == '\'' {
+		path = path[1 : len(path)-1]
+	}
+	if path == "" {
+		return cmd, fmt.Errorf("missing path")
+	}
+	cmd.path = path
+	return cmd, nil
+}
+
+func (s *Server) exec(ch ssh.Channel, command string) (err error) {
+	// a bug must not take the server down with the session
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	cmd, err := parseServeCommand(command)
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "scpw: %v\n", err)
+		return err
+	}
+	if cmd.sink && s.Mode == ServeReadOnly || cmd.source && s.Mode == ServeWriteOnly {
+		return s.fail(ch, fmt.Errorf("permission denied, server is %s", s.Mode))
+	}
+	path, err := s.resolve(cmd.path)
+	if err != nil {
+		return s.fail(ch, err)
+	}
+	// one buffered reader for the whole session, parseMeta reuses it
+	in := bufio.NewReader(ch)
+	if cmd.sink {
+		return s.sink(in, ch, path, cmd)
+	}
+	return s.source(in, ch, path, cmd)
+}
+
+// resolve maps a remote path into Root, symlinks may not leave Root.
+func (s *Server) resolve(path string) (string, error) {
+	full := filepath.Join(s.Root, filepath.Join(string(filepath.Separator), path))
+	if err := s.inside(full, path); err != nil {
+		return "", err
+	}
+	return full, nil
+}
+
+// inside checks that full, a path under Root, stays in Root once its
+// symlinks are followed. name is the path reported.
+func (s *Server) inside(full, name string) error {
+	existing := full
+	for {
+		if real, err := filepath.EvalSymlinks(existing); err == nil {
+			if real != s.Root && !strings.HasPrefix(real, s.Root+string(filepath.Separator)) {
+				return fmt.Errorf("%s: permission denied", name)
+			}
+			return nil
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return nil
+		}
+		existing = parent
+	}
+}
+
+// entry checks a path a recursive copy joined from an entry name, which
+// resolve never saw. A symlink there may not leave Root either.
+func (s *Server) entry(path string) error {
+	stat, err := os.Lstat(path)
+	if err != nil || stat.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	name, err := filepath.Rel(s.Root, path)
+	if err != nil {
+		return err
+	}
+	return s.inside(path, string(filepath.Separator)+name)
+}
+
+// fail reports err to the client with a 0x01 prefixed line like scp does.
+func (s *Server) fail(w io.Writer, err error) error {
+	fmt.Fprintf(w, "\x01scpw: %v\n", err)
+	return err
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+type sinkDir struct {
+	path string
+	attr Attr
+}
+
+func (s *Server) sink(in *bufio.Reader, out io.Writer, target string, cmd serveCommand) error {
+	stat, err := os.Stat(target)
+	targetIsDir := err == nil && stat.IsDir()
+	var stack []sinkDir
+	var times *Attr
+
+	if err = ack(out); err != nil {
+		return err
+	}
+	for {
+		var attr Attr
+		if err = parseMeta(in, &attr); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return s.fail(out, err)
+		}
+		switch attr.Typ {
+		case T:
+			if cmd.keepTime {
+				times = &attr
+			}
+		case E:
+			if len(stack) == 0 {
+				return s.fail(out, fmt.Errorf("unexpected E"))
+			}
+			dir := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !dir.attr.Mtime.IsZero() {
+				if err = os.Chtimes(dir.path, dir.attr.Atime, dir.attr.Mtime); err != nil {
+					return s.fail(out, err)
+				}
+			}
+		case C, D:
+			if !validName(attr.Name) {
+				return s.fail(out, fmt.Errorf("invalid name:[%s]", attr.Name))
+			}
+			path := target
+			if len(stack) > 0 {
+				path = filepath.Join(stack[len(stack)-1].path, attr.Name)
+			} else if targetIsDir {
+				path = filepath.Join(target, attr.Name)
+			}
+			if err = s.entry(path); err != nil {
+				return s.fail(out, err)
+			}
+			if times != nil {
+				attr.Atime, attr.Mtime = times.Atime, times.Mtime
+				times = nil
+			}
+			if attr.Typ == D {
+				if err = s.mkdir(path, attr.Mode, cmd.recursive); err != nil {
+					return s.fail(out, err)
+				}
+				stack = append(stack, sinkDir{path: path, attr: attr})
+				break
+			}
+			// ready for the content
+			if err = ack(out); err != nil {
+				return err
+			}
+			if err = s.receive(in, path, attr); err != nil {
+				return s.fail(out, err)
+			}
+		}
+		if err = ack(out); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) mkdir(path string, mode os.FileMode, recursive bool) error {
+	if !recursive {
+		return fmt.Errorf("received directory without -r")
+	}
+	if stat, err := os.Stat(path); err == nil {
+		if !stat.IsDir() {
+			return fmt.Errorf("%s: not a directory", filepath.Base(path))
+		}
+	} else if err = os.Mkdir(path, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+func (s *Server) receive(in *bufio.Reader, path string, attr Attr) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, attr.Mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(file, in, attr.Size)
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err = checkResponse(in); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err = os.Chmod(path, attr.Mode); err != nil {
+		return err
+	}
+	if !attr.Mtime.IsZero() {
+		return os.Chtimes(path, attr.Atime, attr.Mtime)
+	}
+	return nil
+}
+
+func (s *Server) source(in *bufio.Reader, out io.Writer, path string, cmd serveCommand) error {
+	if err := checkResponse(in); err != nil {
+		return err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return s.fail(out, fmt.Errorf("%s: no such file or directory", cmd.path))
+	}
+	if stat.IsDir() && !cmd.recursive {
+		return s.fail(out, fmt.Errorf("%s: not a regular file", cmd.path))
+	}
+	return s.send(in, out, path, stat, cmd)
+}
+
+func (s *Server) send(in *bufio.Reader, out io.Writer, path string, stat os.FileInfo, cmd serveCommand) error {
+	if cmd.keepTime {
+		atime, mtime := StatTimeV2(stat)
+		if _, err := fmt.Fprintf(out, "T%s 0 %s 0\n", mtime, atime); err != nil {
+			return err
+		}
+		if err := checkResponse(in); err != nil {
+			return err
+		}
+	}
+	if !stat.IsDir() {
+		return s.sendFile(in, out, path, stat)
+	}
+	entries, err := StatDirChild(path)
+	if err != nil {
+		return s.fail(out, err)
+	}
+	if _, err = fmt.Fprintf(out, "D%s 0 %s\n", FileModeV2(stat), stat.Name()); err != nil {
+		return err
+	}
+	if err = checkResponse(in); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		if err = s.entry(child); err != nil {
+			return s.fail(out, err)
+		}
+		childStat, err := os.Stat(child)
+		if err != nil {
+			return s.fail(out, err)
+		}
+		if err = s.send(in, out, child, childStat, cmd); err != nil {
+			return err
+		}
+	}
+	if _, err = fmt.Fprintln(out, E); err != nil {
+		return err
+	}
+	return checkResponse(in)
+}
+
+func (s *Server) sendFile(in *bufio.Reader, out io.Writer, path string, stat os.FileInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return s.fail(out, err)
+	}
+	defer file.Close()
+	if _, err = fmt.Fprintf(out, "C%s %d %s\n", FileModeV2(stat), stat.Size(), stat.Name()); err != nil {
+		return err
+	}
+	if err = checkResponse(in); err != nil {
+		return err
+	}
+	if _, err = io.CopyN(out, file, stat.Size()); err != nil {
+		return err
+	}
+	if err = ack(out); err != nil {
+		return err
+	}
+	return checkResponse(in)
+}
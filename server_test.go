@@ -0,0 +1,220 @@
+package scpw
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startServer serves a fresh root and returns a node logging in with a trusted key.
+func startServer(t *testing.T, mode ServeMode) (*Server, *Node) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	require.Nil(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), os.FileMode(0600)))
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	authorized := filepath.Join(dir, "authorized_keys")
+	require.Nil(t, os.WriteFile(authorized, ssh.MarshalAuthorizedKey(pub), os.FileMode(0600)))
+
+	root := filepath.Join(dir, "root")
+	require.Nil(t, mkdir(root))
+	server, err := NewServer(ServerConfig{Root: root, AuthorizedKeys: authorized, Mode: mode})
+	require.Nil(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.Nil(t, err)
+	return server, &Node{Host: host, Port: port, User: "scpw", KeyPath: keyPath}
+}
+
+func TestParseServeCommand(t *testing.T) {
+	cmd, err := parseServeCommand(`scp -rtp "/a b"`)
+	require.Nil(t, err)
+	assert.Equal(t, serveCommand{sink: true, recursive: true, keepTime: true, path: "/a b"}, cmd)
+
+	cmd, err = parseServeCommand(`scp -f -- 'x y'`)
+	require.Nil(t, err)
+	assert.Equal(t, serveCommand{source: true, path: "x y"}, cmd)
+
+	cmd, err = parseServeCommand(`scp  -t  /a  b`)
+	require.Nil(t, err)
+	assert.Equal(t, serveCommand{sink: true, path: "/a  b"}, cmd)
+
+	for _, c := range []string{`ls /`, `scp -t`, `scp -tf x`, `scp -x x`} {
+		_, err = parseServeCommand(c)
+		assert.NotNil(t, err, c)
+	}
+}
+
+func TestServerResolve(t *testing.T) {
+	server, _ := startServer(t, ServeReadWrite)
+	path, err := server.resolve("/../../etc/passwd")
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join(server.Root, "etc", "passwd"), path)
+
+	require.Nil(t, os.Symlink("/", filepath.Join(server.Root, "escape")))
+	_, err = server.resolve("/escape/etc")
+	assert.NotNil(t, err)
+}
+
+func TestServerPutGet(t *testing.T) {
+	server, node := startServer(t, ServeReadWrite)
+	p := NewProgress()
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
+	ssh, err := NewSSH(node)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	local := RandName(tmpDir)
+	require.Nil(t, writeFile(local))
+	require.Nil(t, scpwCli.Put(ctx, local, "/a"))
+	assertSameFile(t, local, filepath.Join(server.Root, "a"))
+
+	require.Nil(t, scpwCli.PutAll(ctx, baseLocalDir, "/"))
+	assertSameFile(t, filepath.Join(baseLocalDir, "child", "b"), filepath.Join(server.Root, filepath.Base(baseLocalDir), "child", "b"))
+
+	got := RandName(tmpDir)
+	require.Nil(t, scpwCli.Get(ctx, got, "/a"))
+	assertSameFile(t, local, got)
+
+	gotDir := RandName(tmpDir)
+	require.Nil(t, mkdir(gotDir))
+	require.Nil(t, scpwCli.GetAll(ctx, gotDir, "/"+filepath.Base(baseLocalDir)))
+	assertSameFile(t, filepath.Join(baseLocalDir, "child", "b"), filepath.Join(gotDir, filepath.Base(baseLocalDir), "child", "b"))
+
+	assert.NotNil(t, scpwCli.Get(ctx, RandName(tmpDir), "/not-exist"))
+	_, err = scpwCli.Exec("ls /")
+	assert.NotNil(t, err)
+}
+
+func TestServerSymlinkEscape(t *testing.T) {
+	server, node := startServer(t, ServeReadWrite)
+	p := NewProgress()
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
+	ssh, err := NewSSH(node)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+	outside := t.TempDir()
+	before, err := os.Stat(outside)
+	require.Nil(t, err)
+
+	// sink: a directory of the upload is a link out of Root
+	local := filepath.Join(t.TempDir(), "up")
+	require.Nil(t, mkdir(local))
+	require.Nil(t, os.WriteFile(filepath.Join(local, "f"), []byte("x"), 0600))
+	require.Nil(t, os.Symlink(outside, filepath.Join(server.Root, "up")))
+	assert.NotNil(t, scpwCli.PutAll(ctx, local, "/"))
+	_, err = os.Stat(filepath.Join(outside, "f"))
+	assert.True(t, os.IsNotExist(err))
+	stat, err := os.Stat(outside)
+	require.Nil(t, err)
+	assert.Equal(t, before.Mode(), stat.Mode())
+
+	// source: a link in the tree points out of Root
+	require.Nil(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600))
+	require.Nil(t, mkdir(filepath.Join(server.Root, "down")))
+	require.Nil(t, os.Symlink(outside, filepath.Join(server.Root, "down", "out")))
+	got := t.TempDir()
+	assert.NotNil(t, scpwCli.GetAll(ctx, got, "/down"))
+	_, err = os.Stat(filepath.Join(got, "down", "out", "secret"))
+	assert.True(t, os.IsNotExist(err))
+
+	// a link that stays in Root is followed
+	require.Nil(t, mkdir(filepath.Join(server.Root, "in")))
+	require.Nil(t, os.WriteFile(filepath.Join(server.Root, "in", "a"), []byte("a"), 0600))
+	require.Nil(t, os.Remove(filepath.Join(server.Root, "down", "out")))
+	require.Nil(t, os.Symlink(filepath.Join(server.Root, "in"), filepath.Join(server.Root, "down", "in")))
+	got = t.TempDir()
+	require.Nil(t, scpwCli.GetAll(ctx, got, "/down"))
+	b, err := os.ReadFile(filepath.Join(got, "down", "in", "a"))
+	require.Nil(t, err)
+	assert.Equal(t, "a", string(b))
+}
+
+func TestServerMalformedRecord(t *testing.T) {
+	_, node := startServer(t, ServeReadWrite)
+	cli, err := NewSSH(node)
+	require.Nil(t, err)
+	defer cli.Close()
+
+	// a header without a name fails the session, not the server
+	session, err := cli.NewSession()
+	require.Nil(t, err)
+	session.Stdin = bytes.NewBufferString("C0644 5\n")
+	assert.NotNil(t, session.Run("scp -t /x"))
+	session.Close()
+
+	p := NewProgress()
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
+	local := RandName(tmpDir)
+	require.Nil(t, writeFile(local))
+	assert.Nil(t, NewSCP(cli, true).Put(ctx, local, "/x"))
+}
+
+func TestServerGetKeepTime(t *testing.T) {
+	server, node := startServer(t, ServeReadOnly)
+	p := NewProgress()
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
+	ssh, err := NewSSH(node)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	// distinct times, a swapped T record would set the atime as mtime
+	atime, mtime := time.Unix(1446425371, 0), time.Unix(1546425371, 0)
+	dir := filepath.Join(server.Root, "d")
+	require.Nil(t, mkdir(dir))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "f"), []byte("content"), 0600))
+	require.Nil(t, os.Chtimes(filepath.Join(dir, "f"), atime, mtime))
+	require.Nil(t, os.Chtimes(dir, atime, mtime))
+
+	got := filepath.Join(t.TempDir(), "f")
+	require.Nil(t, scpwCli.Get(ctx, got, "/d/f"))
+	stat, err := os.Stat(got)
+	require.Nil(t, err)
+	assert.Equal(t, mtime.Unix(), stat.ModTime().Unix())
+
+	gotDir := t.TempDir()
+	require.Nil(t, scpwCli.GetAll(ctx, gotDir, "/d"))
+	stat, err = os.Stat(filepath.Join(gotDir, "d", "f"))
+	require.Nil(t, err)
+	assert.Equal(t, mtime.Unix(), stat.ModTime().Unix())
+	stat, err = os.Stat(filepath.Join(gotDir, "d"))
+	require.Nil(t, err)
+	assert.Equal(t, mtime.Unix(), stat.ModTime().Unix())
+}
+
+func TestServerMode(t *testing.T) {
+	_, node := startServer(t, ServeReadOnly)
+	p := NewProgress()
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
+	ssh, err := NewSSH(node)
+	require.Nil(t, err)
+	defer ssh.Close()
+	local := RandName(tmpDir)
+	require.Nil(t, writeFile(local))
+	assert.NotNil(t, NewSCP(ssh, true).Put(ctx, local, "/a"))
+
+	_, err = NewServer(ServerConfig{Root: tmpDir, Mode: "rx"})
+	assert.NotNil(t, err)
+}
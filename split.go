@@ -0,0 +1,118 @@
+package scpw
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TreeDir is a remote directory of a split tree.
+type TreeDir struct {
+	Remote string
+	Mode   os.FileMode
+	Mtime  time.Time
+}
+
+// Tree is a local directory split into per-file work items, so the files of
+// one lr-map entry can be uploaded by several connections.
+type Tree struct {
+	// Dirs are created before any file, parents first
+	Dirs  []TreeDir
+	Files []LRMap
+	Size  int64
+}
+
+// SplitTree walks a PUT lr-map entry, a trailing `*` uploads the children of
+// localPath like SwitchScpwFunc does. It returns nil when localPath is a file.
+func SplitTree(localPath, remotePath string) (*Tree, error) {
+	excludeRoot := strings.HasSuffix(localPath, "*")
+	localPath = strings.TrimSuffix(localPath, "*")
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, nil
+	}
+	tree := &Tree{}
+	var walk func(local, remote string, stat os.FileInfo, root bool) error
+	walk = func(local, remote string, stat os.FileInfo, root bool) error {
+		if !root || !excludeRoot {
+			tree.Dirs = append(tree.Dirs, TreeDir{Remote: remote, Mode: stat.Mode().Perm(), Mtime: stat.ModTime()})
+		}
+		child, err := StatDirChild(local)
+		if err != nil {
+			return err
+		}
+		for _, c := range child {
+			l, r := filepath.Join(local, c.Name()), filepath.Join(remote, c.Name())
+			cStat, err := os.Stat(l)
+			if err != nil {
+				return fmt.Errorf("SplitTree failed! root: %s e: %v", local, err)
+			}
+			if cStat.IsDir() {
+				if err = walk(l, r, cStat, false); err != nil {
+					return err
+				}
+				continue
+			}
+			tree.Files = append(tree.Files, LRMap{Local: l, Remote: r})
+			tree.Size += cStat.Size()
+		}
+		return nil
+	}
+	remoteRoot := remotePath
+	if !excludeRoot {
+		remoteRoot = filepath.Join(remotePath, filepath.Base(filepath.Clean(localPath)))
+	}
+	return tree, walk(localPath, remoteRoot, stat, true)
+}
+
+// MkdirTree creates the remote dirs of tree writable, FinishTree applies their
+// modes once the files are in place.
+func (scp *SCP) MkdirTree(tree *Tree) error {
+	var cmds []string
+	for _, dir := range tree.Dirs {
+		cmds = append(cmds, fmt.Sprintf("mkdir -p %q", dir.Remote))
+	}
+	return scp.execBatch(cmds)
+}
+
+// FinishTree sets the modes of the remote dirs, and their times with KeepTime,
+// deepest first since the files were written after the dirs were created.
+func (scp *SCP) FinishTree(tree *Tree) error {
+	var cmds []string
+	for i := len(tree.Dirs) - 1; i >= 0; i-- {
+		dir := tree.Dirs[i]
+		cmd := fmt.Sprintf("chmod %04o %q", dir.Mode, dir.Remote)
+		if scp.KeepTime {
+			cmd += " && " + touchCommand(dir.Remote, dir.Mtime)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return scp.execBatch(cmds)
+}
+
+// touchCommand sets the mtime of a remote path, touch -t is POSIX and the
+// zone is pinned so the remote TZ does not matter.
+func touchCommand(path string, mtime time.Time) string {
+	return fmt.Sprintf("TZ=UTC touch -m -t %s %q", mtime.UTC().Format("200601021504.05"), path)
+}
+
+// execBatch runs cmds joined by && in batches, a large tree would exceed the
+// command line limit of the remote shell.
+func (scp *SCP) execBatch(cmds []string) error {
+	for len(cmds) > 0 {
+		n := verifyBatch
+		if n > len(cmds) {
+			n = len(cmds)
+		}
+		if out, err := scp.Exec(strings.Join(cmds[:n], " && ")); err != nil {
+			return fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+		}
+		cmds = cmds[n:]
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package scpw
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitOf(t *testing.T) {
+	assert.False(t, (&Node{}).SplitOf(LRMap{}))
+	assert.True(t, (&Node{Split: true}).SplitOf(LRMap{}))
+	assert.True(t, (&Node{}).SplitOf(LRMap{Split: true}))
+}
+
+func TestSplitTree(t *testing.T) {
+	local := t.TempDir()
+	require.Nil(t, writeFile(filepath.Join(local, "a")))
+	require.Nil(t, mkdir(filepath.Join(local, "child")))
+	require.Nil(t, writeFile(filepath.Join(local, "child", "b")))
+
+	tree, err := SplitTree(filepath.Join(local, "a"), "/remote")
+	assert.Nil(t, err)
+	assert.Nil(t, tree)
+
+	root := filepath.Join("/remote", filepath.Base(local))
+	tree, err = SplitTree(local, "/remote")
+	require.Nil(t, err)
+	require.Len(t, tree.Dirs, 2)
+	assert.Equal(t, root, tree.Dirs[0].Remote)
+	assert.Equal(t, filepath.Join(root, "child"), tree.Dirs[1].Remote)
+	assert.Equal(t, []LRMap{
+		{Local: filepath.Join(local, "a"), Remote: filepath.Join(root, "a")},
+		{Local: filepath.Join(local, "child", "b"), Remote: filepath.Join(root, "child", "b")},
+	}, tree.Files)
+	assert.Equal(t, int64(8), tree.Size)
+
+	tree, err = SplitTree(local+"/*", "/remote")
+	require.Nil(t, err)
+	require.Len(t, tree.Dirs, 1)
+	assert.Equal(t, "/remote/child", tree.Dirs[0].Remote)
+	assert.Len(t, tree.Files, 2)
+
+	_, err = SplitTree(filepath.Join(local, "not-exist"), "/remote")
+	assert.NotNil(t, err)
+}
+
+func TestSplitPut(t *testing.T) {
+	local := RandName(tmpDir)
+	require.Nil(t, mkdir(local))
+	for _, dir := range []string{"x", "x/y", "z"} {
+		require.Nil(t, mkdir(filepath.Join(local, dir)))
+	}
+	for _, file := range []string{"1", "x/2", "x/y/3", "x/y/4", "z/5"} {
+		require.Nil(t, writeFile(filepath.Join(local, file)))
+	}
+	require.Nil(t, os.Chmod(filepath.Join(local, "z"), 0750))
+	past := time.Unix(1600000000, 0)
+	for _, dir := range []string{"x/y", "x", "z", ""} {
+		require.Nil(t, os.Chtimes(filepath.Join(local, dir), past, past))
+	}
+
+	remote := RandName(tmpDir)
+	require.Nil(t, mkdir(remote))
+	tree, err := SplitTree(local, remote)
+	require.Nil(t, err)
+
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	control := NewSCP(ssh, true)
+	require.Nil(t, control.MkdirTree(tree))
+
+	p := NewProgress()
+	ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar("")}
+	todo := make(chan LRMap, len(tree.Files))
+	for _, file := range tree.Files {
+		todo <- file
+	}
+	close(todo)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ssh, err := NewSSH(testNode)
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer ssh.Close()
+			scpwCli := NewSCP(ssh, true)
+			for file := range todo {
+				assert.Nil(t, scpwCli.Put(ctx, file.Local, file.Remote))
+			}
+		}()
+	}
+	wg.Wait()
+	require.Nil(t, control.FinishTree(tree))
+
+	root := filepath.Join(remote, filepath.Base(local))
+	for _, file := range []string{"1", "x/2", "x/y/3", "x/y/4", "z/5"} {
+		assertSameFile(t, filepath.Join(local, file), filepath.Join(root, file))
+	}
+	for _, dir := range []string{"", "x", "x/y", "z"} {
+		expected, err := os.Stat(filepath.Join(local, dir))
+		require.Nil(t, err)
+		actual, err := os.Stat(filepath.Join(root, dir))
+		require.Nil(t, err)
+		assert.Equal(t, expected.Mode(), actual.Mode(), dir)
+		assert.Equal(t, expected.ModTime().Unix(), actual.ModTime().Unix(), dir)
+	}
+}
@@ -3,9 +3,11 @@ package scpw
 import (
 	"fmt"
 	"github.com/google/uuid"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -40,8 +42,29 @@ func MaxInt64(a, b int64) int64 {
 	return b
 }
 
-func Addr(ip, port string) string {
-	return fmt.Sprintf("%s:%s", ip, port)
+// Addr joins host and port for a dial, an IPv6 host is bracketed and an
+// empty port is DefaultPort.
+func Addr(host, port string) string {
+	if port == "" {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
+
+// SplitHost splits the port off `host:port` or `[ipv6]:port`, port is empty
+// when host has none. A bare IPv6 address has no port.
+func SplitHost(host string) (string, string, error) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1], "", nil
+	}
+	if !strings.HasPrefix(host, "[") && strings.Count(host, ":") != 1 {
+		return host, "", nil
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid host %q, expect host, host:port or [ipv6]:port", host)
+	}
+	return h, port, nil
 }
 
 func FileModeV1(root string) (string, error) {
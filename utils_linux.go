@@ -1,7 +1,10 @@
 package scpw
 
 import (
+	"errors"
 	"os"
+	"os/exec"
+	"os/user"
 	"strconv"
 	"syscall"
 )
@@ -12,3 +15,17 @@ func StatTimeV2(file os.FileInfo) (string, string) {
 	mtime := strconv.FormatInt(stat.Mtim.Sec, 10)
 	return atime, mtime
 }
+
+func ShellCommand(cmd string) *exec.Cmd {
+	return exec.Command("sh", "-c", cmd)
+}
+
+// loginName is the name of u on a server.
+func loginName(u *user.User) string {
+	return u.Username
+}
+
+// crossDevice reports whether err is a rename across filesystems.
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
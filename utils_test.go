@@ -36,6 +36,25 @@ func TestMaxInt64(t *testing.T) {
 
 func TestAddr(t *testing.T) {
 	require.Equal(t, "127.0.0.1:80", Addr("127.0.0.1", "80"))
+	require.Equal(t, "127.0.0.1:22", Addr("127.0.0.1", ""))
+	require.Equal(t, "[::1]:2222", Addr("::1", "2222"))
+	require.Equal(t, "[fe80::1]:22", Addr("[fe80::1]", ""))
+}
+
+func TestSplitHost(t *testing.T) {
+	for host, want := range map[string][2]string{
+		"example.com":      {"example.com", ""},
+		"example.com:2222": {"example.com", "2222"},
+		"::1":              {"::1", ""},
+		"[::1]":            {"::1", ""},
+		"[::1]:2222":       {"::1", "2222"},
+	} {
+		h, port, err := SplitHost(host)
+		require.Nil(t, err, host)
+		require.Equal(t, want, [2]string{h, port}, host)
+	}
+	_, _, err := SplitHost("[::1]2222")
+	require.NotNil(t, err)
 }
 
 func TestFileModeV1(t *testing.T) {
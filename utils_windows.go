@@ -1,8 +1,12 @@
 package scpw
 
 import (
+	"errors"
 	"os"
+	"os/exec"
+	"os/user"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -13,3 +17,18 @@ func StatTimeV2(file os.FileInfo) (string, string) {
 	mtime := time.Unix(0, stat.LastWriteTime.Nanoseconds()).Unix()
 	return strconv.FormatInt(atime, 10), strconv.FormatInt(mtime, 10)
 }
+
+func ShellCommand(cmd string) *exec.Cmd {
+	return exec.Command("cmd", "/C", cmd)
+}
+
+// loginName is the name of u on a server, without the DOMAIN\ prefix of a
+// Windows account.
+func loginName(u *user.User) string {
+	return u.Username[strings.LastIndex(u.Username, `\`)+1:]
+}
+
+// crossDevice reports whether err is a rename across volumes, ERROR_NOT_SAME_DEVICE.
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.Errno(17))
+}
@@ -0,0 +1,486 @@
+package scpw
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigError is a problem of the config at a position of its file, Column is 0
+// when the yaml decoder only reports the line.
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ConfigError) Error() string {
+	// a TOML config has no positions
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	if e.Column == 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// ConfigErrors are all the problems found in a config, in file order.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+var (
+	nodeKeys  = yamlKeys(reflect.TypeOf(Node{}))
+	lrMapKeys = yamlKeys(reflect.TypeOf(LRMap{}))
+)
+
+// yamlKeys returns the keys a struct is decoded from.
+func yamlKeys(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		if key := yamlKey(t.Field(i)); key != "" && key != "-" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// yamlKey returns the key field is decoded from.
+func yamlKey(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("yaml"), ",")[0]
+}
+
+// ConfigFile is the content of a config file.
+type ConfigFile struct {
+	Path string
+	Data []byte
+	// Includes are more files whose nodes are added to the ones of this file
+	Includes []string
+}
+
+// ParseConfig validates and decodes a config, unknown keys are rejected. file
+// only names the positions of the errors and resolves relative includes.
+func ParseConfig(file string, b []byte) ([]*Node, error) {
+	return ParseConfigFiles([]ConfigFile{{Path: file, Data: b}})
+}
+
+// ParseConfigFiles merges files in order, see mergeNodes, then validates and
+// decodes the result. The includes of a file are part of it, they are not
+// merged, see loader. Every error names the file its position is in.
+func ParseConfigFiles(files []ConfigFile) ([]*Node, error) {
+	nodes, _, _, err := parseConfigFiles(files)
+	return nodes, err
+}
+
+// parseConfigFiles also returns the paths of all files read, includes too,
+// and the keys every node sets itself, see ownKeys.
+func parseConfigFiles(files []ConfigFile) ([]*Node, []string, map[*Node]map[string]bool, error) {
+	v := &validator{names: map[string]*yaml.Node{}, files: map[*yaml.Node]string{}, order: map[string]int{}}
+	l := &loader{v: v, templates: map[string]*yaml.Node{}, resolved: map[string]*yaml.Node{}}
+	var root *yaml.Node
+	for _, f := range files {
+		seq, err := l.load(f.Path, f.Data)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, include := range f.Includes {
+			if seq, err = l.splice(seq, nil, include); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		switch {
+		case seq == nil:
+		case root == nil:
+			root = seq
+		default:
+			mergeNodes(root, seq)
+		}
+	}
+	if root != nil {
+		l.extend(root, true)
+		v.expandTemplates(root, newTemplateData(time.Now()))
+		v.nodes(root, nil)
+	}
+	if len(v.errs) > 0 {
+		sort.SliceStable(v.errs, func(i, j int) bool {
+			a, b := v.errs[i], v.errs[j]
+			if v.order[a.File] != v.order[b.File] {
+				return v.order[a.File] < v.order[b.File]
+			}
+			return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+		})
+		return nil, nil, nil, v.errs
+	}
+	// the validator rejects the unknown keys, the loader the values of a wrong type
+	if l.typeErr != nil {
+		return nil, nil, nil, l.typeErr
+	}
+	var config []*Node
+	own := map[*Node]map[string]bool{}
+	if root != nil {
+		if err := root.Decode(&config); err != nil {
+			return nil, nil, nil, err
+		}
+		ownKeys(root, config, own)
+	}
+	read := make([]string, len(v.order))
+	for path, i := range v.order {
+		read[i] = path
+	}
+	return config, read, own, nil
+}
+
+// ownKeys records the keys the nodes of seq, decoded into nodes, set
+// themselves, so inherit tells a false or 0 a child sets from a key it
+// leaves out.
+func ownKeys(seq *yaml.Node, nodes []*Node, own map[*Node]map[string]bool) {
+	for i := 0; i < len(seq.Content) && i < len(nodes); i++ {
+		n, keys := seq.Content[i], map[string]bool{}
+		for j := 0; j+1 < len(n.Content); j += 2 {
+			if isSet(n.Content[j+1]) {
+				keys[n.Content[j].Value] = true
+			}
+		}
+		own[nodes[i]] = keys
+		if c := indexOfKey(n, "children"); c >= 0 {
+			ownKeys(n.Content[c+1], nodes[i].Children, own)
+		}
+	}
+}
+
+// isSet reports whether value sets its key, an empty or null scalar does not.
+func isSet(value *yaml.Node) bool {
+	return value.Kind != yaml.ScalarNode || value.Value != "" && value.Tag != "!!null"
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlError locates the messages of a yaml.v3 error, which carry the line only.
+func yamlError(file string, err error) error {
+	msgs := []string{err.Error()}
+	if e, ok := err.(*yaml.TypeError); ok {
+		msgs = e.Errors
+	}
+	var errs ConfigErrors
+	for _, msg := range msgs {
+		ce := &ConfigError{File: file, Msg: strings.TrimPrefix(msg, "yaml: ")}
+		if m := yamlLine.FindStringSubmatch(msg); m != nil {
+			ce.Line, _ = strconv.Atoi(m[1])
+			ce.Msg = m[2]
+		}
+		errs = append(errs, ce)
+	}
+	return errs
+}
+
+// validator walks the yaml tree of a config, so every error points at the
+// key or value it is about.
+type validator struct {
+	// files are the files the yaml nodes were read from, merged trees mix them
+	files map[*yaml.Node]string
+	// order is the order the files were read in, errors are sorted by it
+	order map[string]int
+	// names are the name values of the nodes seen so far
+	names map[string]*yaml.Node
+	errs  ConfigErrors
+}
+
+// own records n and its descendants as read from file.
+func (v *validator) own(n *yaml.Node, file string) {
+	if _, ok := v.order[file]; !ok {
+		v.order[file] = len(v.order)
+	}
+	v.files[n] = file
+	for _, c := range n.Content {
+		v.own(c, file)
+	}
+}
+
+func (v *validator) errorf(n *yaml.Node, format string, a ...interface{}) {
+	v.errs = append(v.errs, &ConfigError{File: v.files[n], Line: n.Line, Column: n.Column, Msg: fmt.Sprintf(format, a...)})
+}
+
+// position is where n is, with its file when that is not the file of at.
+func (v *validator) position(n, at *yaml.Node) string {
+	if v.files[n] != v.files[at] {
+		return fmt.Sprintf("%s:%d", v.files[n], n.Line)
+	}
+	return fmt.Sprintf("line %d", n.Line)
+}
+
+// nodes validates a list of nodes, the document root or children. inherited
+// are the keys set by the parents, which the nodes need not repeat.
+func (v *validator) nodes(seq *yaml.Node, inherited map[string]bool) {
+	if seq.Kind != yaml.SequenceNode {
+		v.errorf(seq, "expect a list of nodes")
+		return
+	}
+	for _, n := range seq.Content {
+		v.node(n, inherited)
+	}
+}
+
+func (v *validator) node(n *yaml.Node, inherited map[string]bool) {
+	fields := v.mapping(n, "node", nodeKeys)
+	if fields == nil {
+		return
+	}
+	name := v.required(n, fields, "name")
+	if name != nil && name.Value != "" {
+		if first, ok := v.names[name.Value]; ok {
+			v.errorf(name, "duplicate node name %q, first defined at %s", name.Value, v.position(first, name))
+		} else {
+			v.names[name.Value] = name
+		}
+	}
+
+	children, lrMap := fields["children"], fields["lr-map"]
+	// a group node only holds children, it is never transferred itself
+	group := children != nil && children.Kind == yaml.SequenceNode && len(children.Content) > 0
+	if !group || lrMap != nil {
+		for _, key := range []string{"host", "type"} {
+			if !inherited[key] {
+				v.required(n, fields, key)
+			}
+		}
+		if lrMap == nil {
+			v.errorf(n, "missing lr-map")
+		} else if lrMap.Kind == yaml.SequenceNode && len(lrMap.Content) == 0 {
+			v.errorf(lrMap, "lr-map is empty")
+		}
+	}
+
+	if typ := v.scalar(fields, "type"); typ != nil && typ.Value != "" && typ.Value != PUT && typ.Value != GET {
+		v.errorf(typ, "invalid type %q, expect %s or %s", typ.Value, PUT, GET)
+	}
+	port := v.scalar(fields, "port")
+	if port != nil && port.Value != "" && !validPort(port.Value) {
+		v.errorf(port, "invalid port %q, expect 1-65535", port.Value)
+	}
+	if host := v.scalar(fields, "host"); host != nil && host.Value != "" {
+		if _, p, err := SplitHost(host.Value); err != nil {
+			v.errorf(host, "%v", err)
+		} else if p != "" && !validPort(p) {
+			v.errorf(host, "invalid port %q, expect 1-65535", p)
+		} else if p != "" && port != nil && port.Value != "" && port.Value != p {
+			v.errorf(port, "port %s conflicts with the port of host %s", port.Value, host.Value)
+		}
+	}
+	// one way to log in
+	var auth *yaml.Node
+	for _, key := range []string{"keypath", "password", "password-env", "password-cmd", "password-secret"} {
+		value := v.scalar(fields, key)
+		if value == nil || value.Value == "" {
+			continue
+		}
+		if auth != nil {
+			v.errorf(value, "%s conflicts with %s", key, v.key(n, auth))
+			continue
+		}
+		auth = value
+	}
+	if secret := v.scalar(fields, "password-secret"); secret != nil && secret.Value != "" {
+		if scheme, _, ok := strings.Cut(secret.Value, ":"); !ok || !contains(SecretSchemes(), scheme) {
+			v.errorf(secret, "invalid password-secret %q, expect <%s>:<key>", secret.Value, strings.Join(SecretSchemes(), "|"))
+		}
+	}
+	v.enum(fields, "verify", SHA256, MD5, XXHASH)
+	v.enum(fields, "compression", CompressOff, CompressOn, CompressAuto)
+	v.enum(fields, "post-hooks-on-failure", HookSkip, HookForce)
+	v.backup(fields)
+	if vars := fields["vars"]; vars != nil {
+		if vars.Kind != yaml.MappingNode {
+			v.errorf(vars, "vars expects a mapping, got %s", kindOf(vars))
+		} else {
+			for i := 1; i < len(vars.Content); i += 2 {
+				if vars.Content[i].Kind != yaml.ScalarNode {
+					v.errorf(vars.Content[i], "var %s expects a scalar, got %s", vars.Content[i-1].Value, kindOf(vars.Content[i]))
+				}
+			}
+		}
+	}
+
+	if lrMap != nil {
+		if lrMap.Kind != yaml.SequenceNode {
+			v.errorf(lrMap, "expect a list of lr-map entries")
+		} else {
+			for _, lr := range lrMap.Content {
+				v.lrMap(lr)
+			}
+		}
+	}
+	if children != nil {
+		set := map[string]bool{}
+		for key := range inherited {
+			set[key] = true
+		}
+		for key, value := range fields {
+			if isSet(value) {
+				set[key] = true
+			}
+		}
+		v.nodes(children, set)
+	}
+}
+
+func (v *validator) lrMap(n *yaml.Node) {
+	fields := v.mapping(n, "lr-map entry", lrMapKeys)
+	if fields == nil {
+		return
+	}
+	v.required(n, fields, "local")
+	v.required(n, fields, "remote")
+	v.enum(fields, "verify", SHA256, MD5, XXHASH)
+	v.backup(fields)
+}
+
+// mapping returns the values of n by key, or nil when n is not a mapping.
+// Keys that are not in known are reported.
+func (v *validator) mapping(n *yaml.Node, what string, known []string) map[string]*yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		v.errorf(n, "expect a %s, got %s", what, kindOf(n))
+		return nil
+	}
+	fields := map[string]*yaml.Node{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if !contains(known, key.Value) {
+			if s := closest(key.Value, known); s != "" {
+				v.errorf(key, "unknown field %q in %s, did you mean %q?", key.Value, what, s)
+			} else {
+				v.errorf(key, "unknown field %q in %s", key.Value, what)
+			}
+			continue
+		}
+		fields[key.Value] = value
+	}
+	return fields
+}
+
+// scalar returns the value of key, nil when it is absent or not a scalar.
+func (v *validator) scalar(fields map[string]*yaml.Node, key string) *yaml.Node {
+	n := fields[key]
+	if n == nil {
+		return nil
+	}
+	if n.Kind != yaml.ScalarNode {
+		v.errorf(n, "%s expects a scalar, got %s", key, kindOf(n))
+		delete(fields, key)
+		return nil
+	}
+	// `key:` and `key: ~` are empty values
+	if n.Tag == "!!null" {
+		n.Value = ""
+	}
+	return n
+}
+
+// required reports key when it is absent or empty.
+func (v *validator) required(n *yaml.Node, fields map[string]*yaml.Node, key string) *yaml.Node {
+	if indexOfKey(n, key) < 0 {
+		v.errorf(n, "missing %s", key)
+		return nil
+	}
+	value := v.scalar(fields, key)
+	if value != nil && value.Value == "" {
+		v.errorf(value, "%s is empty", key)
+	}
+	return value
+}
+
+// key returns the key of value in the mapping n.
+func (v *validator) key(n, value *yaml.Node) string {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i+1] == value {
+			return n.Content[i].Value
+		}
+	}
+	return ""
+}
+
+func (v *validator) enum(fields map[string]*yaml.Node, key string, values ...string) {
+	n := v.scalar(fields, key)
+	if n == nil || n.Value == "" || contains(values, n.Value) {
+		return
+	}
+	v.errorf(n, "invalid %s %q, expect one of %s", key, n.Value, strings.Join(values, ", "))
+}
+
+func (v *validator) backup(fields map[string]*yaml.Node) {
+	if n := v.scalar(fields, "backup"); n != nil {
+		if _, err := ParseBackup(n.Value, ""); err != nil {
+			v.errorf(n, "%v", err)
+		}
+	}
+}
+
+func validPort(s string) bool {
+	p, err := strconv.Atoi(s)
+	return err == nil && p >= 1 && p <= 65535
+}
+
+func kindOf(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.AliasNode:
+		return "an alias"
+	default:
+		return fmt.Sprintf("%q", n.Value)
+	}
+}
+
+func contains(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// closest returns the known key a typo most likely meant, empty when none is close.
+func closest(s string, known []string) string {
+	best, min := "", 3
+	for _, k := range known {
+		if d := editDistance(s, k); d < min {
+			best, min = k, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = MinInt(MinInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
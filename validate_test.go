@@ -0,0 +1,140 @@
+package scpw
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig("scpw.yml", []byte(`
+- name: group
+  children:
+  - name: web
+    host: 10.0.0.1
+    user: root
+    port: 2222
+    password: "123"
+    type: PUT
+    compression: true
+    backup: keep-last-3
+    lr-map:
+    - local: /tmp/a
+      remote: /tmp/b
+      verify: xxhash
+`))
+	require.Nil(t, err)
+	require.Len(t, config, 1)
+	require.Len(t, config[0].Children, 1)
+	web := config[0].Children[0]
+	assert.Equal(t, "2222", web.Port)
+	assert.Equal(t, CompressOn, web.Compression)
+	assert.Equal(t, PUT, web.Typ)
+	assert.Equal(t, XXHASH, web.LRMap[0].Verify)
+
+	// children need not repeat what their parents set
+	config, err = ParseConfig("scpw.yml", []byte(`
+- name: group
+  user: root
+  type: GET
+  children:
+  - name: a
+    host: 10.0.0.1
+    lr-map: [{ local: /tmp/a, remote: /tmp/b }]
+`))
+	require.Nil(t, err)
+	require.Len(t, config, 1)
+
+	config, err = ParseConfig("scpw.yml", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, config)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	_, err := ParseConfig("scpw.yml", []byte(`- name: web
+  host: 10.0.0.1
+  user: root
+  typ: PUT
+  lr-map:
+  - local: /tmp/a
+    remote: /tmp/b
+`))
+	require.IsType(t, ConfigErrors{}, err)
+	assert.Equal(t, `scpw.yml:1:3: missing type
+scpw.yml:4:3: unknown field "typ" in node, did you mean "type"?`, err.Error())
+
+	_, err = ParseConfig("scpw.yml", []byte(`- name: web
+  host: 10.0.0.1
+  user: root
+  port: 70000
+  password: "123"
+  keypath: ~/.ssh/id_rsa
+  type: put
+  verify: crc
+  lr-map: []
+- name: web
+  children:
+  - name: db
+    host: 10.0.0.2
+    user: root
+    type: GET
+    lr-map:
+    - local: /tmp/a
+      remote:
+`))
+	require.IsType(t, ConfigErrors{}, err)
+	assert.Equal(t, ConfigErrors{
+		{File: "scpw.yml", Line: 4, Column: 9, Msg: `invalid port "70000", expect 1-65535`},
+		{File: "scpw.yml", Line: 5, Column: 13, Msg: "password conflicts with keypath"},
+		{File: "scpw.yml", Line: 7, Column: 9, Msg: `invalid type "put", expect PUT or GET`},
+		{File: "scpw.yml", Line: 8, Column: 11, Msg: "invalid verify \"crc\", expect one of sha256, md5, xxhash"},
+		{File: "scpw.yml", Line: 9, Column: 11, Msg: "lr-map is empty"},
+		{File: "scpw.yml", Line: 10, Column: 9, Msg: `duplicate node name "web", first defined at line 1`},
+		{File: "scpw.yml", Line: 18, Column: 14, Msg: "remote is empty"},
+	}, err)
+
+	// the strict decode catches values of a wrong type
+	_, err = ParseConfig("scpw.yml", []byte(`- name: web
+  host: 10.0.0.1
+  user: root
+  type: PUT
+  chunks: many
+  lr-map:
+  - local: /tmp/a
+    remote: /tmp/b
+`))
+	require.IsType(t, ConfigErrors{}, err)
+	assert.Contains(t, err.Error(), "scpw.yml:5: cannot unmarshal")
+
+	_, err = ParseConfig("scpw.yml", []byte("- name: [web\n"))
+	assert.NotNil(t, err)
+	_, err = ParseConfig("scpw.yml", []byte("web\n"))
+	assert.Equal(t, "scpw.yml:1:1: expect a list of nodes or a mapping of defaults, templates, nodes, include", err.Error())
+}
+
+func TestParseConfigAuth(t *testing.T) {
+	_, err := ParseConfig("scpw.yml", []byte(`- name: web
+  host: 10.0.0.1
+  user: root
+  type: PUT
+  password-env: WEB_PASSWORD
+  password-cmd: pass show web
+  password-secret: safe:web
+  lr-map: [{ local: /tmp/a, remote: /tmp/b }]
+`))
+	assert.Equal(t, `scpw.yml:6:17: password-cmd conflicts with password-env
+scpw.yml:7:20: password-secret conflicts with password-env
+scpw.yml:7:20: invalid password-secret "safe:web", expect <vault>:<key>`, err.Error())
+}
+
+func TestParseConfigHost(t *testing.T) {
+	_, err := ParseConfig("scpw.yml", []byte(`
+- { name: a, host: "10.0.0.1:2222", type: PUT, lr-map: [{ local: /a, remote: /b }] }
+- { name: b, host: "10.0.0.1:2222", port: 2200, type: PUT, lr-map: [{ local: /a, remote: /b }] }
+- { name: c, host: "10.0.0.1:0", type: PUT, lr-map: [{ local: /a, remote: /b }] }
+- { name: d, host: "[::1]x", type: PUT, lr-map: [{ local: /a, remote: /b }] }
+`))
+	assert.Equal(t, `scpw.yml:3:43: port 2200 conflicts with the port of host 10.0.0.1:2222
+scpw.yml:4:20: invalid port "0", expect 1-65535
+scpw.yml:5:20: invalid host "[::1]x", expect host, host:port or [ipv6]:port`, err.Error())
+}
@@ -0,0 +1,242 @@
+package scpw
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// sealMagic starts the data of Seal, the version selects the key derivation.
+var sealMagic = []byte("SCPW1\n")
+
+// scrypt cost, about 100ms to derive a key
+var scryptN = 1 << 15
+
+const (
+	saltSize = 16
+	keySize  = 32
+)
+
+// Seal encrypts plaintext with AES-256-GCM under a key derived from
+// passphrase with scrypt and a random salt.
+func Seal(passphrase, plaintext []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	data := append(append(append([]byte{}, sealMagic...), salt...), nonce...)
+	return gcm.Seal(data, nonce, plaintext, sealMagic), nil
+}
+
+// Unseal decrypts the data of Seal, a wrong passphrase fails the
+// authentication of the ciphertext.
+func Unseal(passphrase, data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return nil, fmt.Errorf("not sealed by scpw")
+	}
+	data = data[len(sealMagic):]
+	if len(data) < saltSize {
+		return nil, fmt.Errorf("sealed data is truncated")
+	}
+	gcm, err := newGCM(passphrase, data[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	data = data[saltSize:]
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed data is truncated")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], sealMagic)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted data")
+	}
+	return plaintext, nil
+}
+
+// IsSealed reports whether data was produced by Seal.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealMagic)
+}
+
+func newGCM(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Vault is a file of secrets sealed with a passphrase, the default resolver
+// of `password-secret: vault:<key>`.
+type Vault struct {
+	// Path is $SCPW_VAULT or ~/.scpw.vault when empty
+	Path string
+	// Passphrase is $SCPW_VAULT_PASSPHRASE or asked on the terminal when nil,
+	// create is true when the vault does not exist yet
+	Passphrase func(create bool) ([]byte, error)
+
+	mu      sync.Mutex
+	pass    []byte
+	secrets map[string]string
+}
+
+// Resolve returns the secret of key, the vault is opened once.
+func (v *Vault) Resolve(key string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.open(false); err != nil {
+		return "", err
+	}
+	secret, ok := v.secrets[key]
+	if !ok {
+		return "", fmt.Errorf("secret:[%s] not found in vault:[%s]", key, v.path())
+	}
+	return secret, nil
+}
+
+// Set stores secret as key, the vault is created when it does not exist.
+func (v *Vault) Set(key, secret string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.open(true); err != nil {
+		return err
+	}
+	v.secrets[key] = secret
+	return v.save()
+}
+
+// Delete removes key, which must exist.
+func (v *Vault) Delete(key string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.open(false); err != nil {
+		return err
+	}
+	if _, ok := v.secrets[key]; !ok {
+		return fmt.Errorf("secret:[%s] not found in vault:[%s]", key, v.path())
+	}
+	delete(v.secrets, key)
+	return v.save()
+}
+
+// Keys returns the keys of the vault, sorted.
+func (v *Vault) Keys() ([]string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.open(false); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range v.secrets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (v *Vault) path() string {
+	if v.Path != "" {
+		return v.Path
+	}
+	if path := os.Getenv("SCPW_VAULT"); path != "" {
+		return path
+	}
+	if u, err := user.Current(); err == nil {
+		return filepath.Join(u.HomeDir, ".scpw.vault")
+	}
+	return ".scpw.vault"
+}
+
+// open reads the vault unless it is open, a missing vault is empty when it
+// may be created.
+func (v *Vault) open(create bool) error {
+	if v.secrets != nil {
+		return nil
+	}
+	data, err := os.ReadFile(v.path())
+	create = create && errors.Is(err, os.ErrNotExist)
+	if err != nil && !create {
+		return fmt.Errorf("open vault failed! e: %v", err)
+	}
+	passphrase := v.Passphrase
+	if passphrase == nil {
+		passphrase = vaultPassphrase
+	}
+	pass, err := passphrase(create)
+	if err != nil {
+		return err
+	}
+	secrets := map[string]string{}
+	if !create {
+		plaintext, err := Unseal(pass, data)
+		if err != nil {
+			return fmt.Errorf("open vault:[%s] failed! e: %v", v.path(), err)
+		}
+		if err = json.Unmarshal(plaintext, &secrets); err != nil {
+			return fmt.Errorf("open vault:[%s] failed! e: %v", v.path(), err)
+		}
+	}
+	v.pass, v.secrets = pass, secrets
+	return nil
+}
+
+// save seals the secrets into a temp file renamed over the vault, a failed
+// write keeps the previous vault.
+func (v *Vault) save() error {
+	plaintext, err := json.Marshal(v.secrets)
+	if err != nil {
+		return err
+	}
+	data, err := Seal(v.pass, plaintext)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(v.path(), data, 0600)
+}
+
+func vaultPassphrase(create bool) ([]byte, error) {
+	if pass, ok := os.LookupEnv("SCPW_VAULT_PASSPHRASE"); ok {
+		return []byte(pass), nil
+	}
+	return ReadPassphrase("vault passphrase: ", create)
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := AtomicName(path)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,76 @@
+package scpw
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeal(t *testing.T) {
+	n := scryptN
+	defer func() { scryptN = n }()
+	scryptN = 1 << 10
+
+	data, err := Seal([]byte("passphrase"), []byte("secret"))
+	require.Nil(t, err)
+	assert.True(t, IsSealed(data))
+	assert.NotContains(t, string(data), "secret")
+	plaintext, err := Unseal([]byte("passphrase"), data)
+	require.Nil(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+
+	_, err = Unseal([]byte("wrong"), data)
+	assert.NotNil(t, err)
+	data[len(data)-1] ^= 1
+	_, err = Unseal([]byte("passphrase"), data)
+	assert.NotNil(t, err)
+	_, err = Unseal([]byte("passphrase"), data[:10])
+	assert.NotNil(t, err)
+	_, err = Unseal([]byte("passphrase"), []byte("plain"))
+	assert.NotNil(t, err)
+}
+
+func TestVault(t *testing.T) {
+	n := scryptN
+	defer func() { scryptN = n }()
+	scryptN = 1 << 10
+
+	path := filepath.Join(t.TempDir(), "vault")
+	asked := 0
+	newVault := func(pass string) *Vault {
+		return &Vault{Path: path, Passphrase: func(create bool) ([]byte, error) {
+			asked++
+			return []byte(pass), nil
+		}}
+	}
+	v := newVault("passphrase")
+	_, err := v.Resolve("web")
+	assert.NotNil(t, err)
+	require.Nil(t, v.Set("web", "123"))
+	require.Nil(t, v.Set("db", "456"))
+	stat, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	v = newVault("passphrase")
+	secret, err := v.Resolve("web")
+	require.Nil(t, err)
+	assert.Equal(t, "123", secret)
+	keys, err := v.Keys()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"db", "web"}, keys)
+	require.Nil(t, v.Delete("web"))
+	assert.NotNil(t, v.Delete("web"))
+	_, err = v.Resolve("web")
+	assert.NotNil(t, err)
+	// once per vault, not for a vault that does not exist
+	assert.Equal(t, 2, asked)
+
+	_, err = newVault("wrong").Resolve("db")
+	assert.NotNil(t, err)
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
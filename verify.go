@@ -0,0 +1,136 @@
+package scpw
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"hash"
+	"io"
+	"strings"
+)
+
+type VerifyType = string
+
+const (
+	SHA256 VerifyType = "sha256"
+	MD5    VerifyType = "md5"
+	XXHASH VerifyType = "xxhash"
+)
+
+// number of remote paths hashed by one remote command
+var verifyBatch = 64
+
+type checksum struct {
+	remote string
+	sum    string
+}
+
+func NewVerifyHash(typ VerifyType) (hash.Hash, error) {
+	switch typ {
+	case SHA256:
+		return sha256.New(), nil
+	case MD5:
+		return md5.New(), nil
+	case XXHASH:
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("invalid verify type:[%s]", typ)
+	}
+}
+
+func verifyCommand(typ VerifyType) (string, error) {
+	switch typ {
+	case SHA256:
+		return "sha256sum", nil
+	case MD5:
+		return "md5sum", nil
+	case XXHASH:
+		return "xxhsum -H1", nil
+	default:
+		return "", fmt.Errorf("invalid verify type:[%s]", typ)
+	}
+}
+
+// newHash returns nil when the context does not ask for verification.
+func (ctx Context) newHash() (hash.Hash, error) {
+	if ctx.Verify == "" {
+		return nil, nil
+	}
+	return NewVerifyHash(ctx.Verify)
+}
+
+func hashWriter(w io.Writer, h hash.Hash) io.Writer {
+	if h == nil {
+		return w
+	}
+	return io.MultiWriter(w, h)
+}
+
+func hashReader(r io.Reader, h hash.Hash) io.Reader {
+	if h == nil {
+		return r
+	}
+	return io.TeeReader(r, h)
+}
+
+func sumOf(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RemoteSum hashes remote paths with the `sha256sum`-style command of typ,
+// sums are returned in the same order as paths.
+func (scp *SCP) RemoteSum(typ VerifyType, paths ...string) ([]string, error) {
+	cmd, err := verifyCommand(typ)
+	if err != nil {
+		return nil, err
+	}
+	var sums []string
+	for start := 0; start < len(paths); start += verifyBatch {
+		batch := paths[start:MinInt(start+verifyBatch, len(paths))]
+		args := make([]string, len(batch))
+		for i := range batch {
+			args[i] = fmt.Sprintf("%q", batch[i])
+		}
+		out, err := scp.Output(cmd + " " + strings.Join(args, " "))
+		if err != nil {
+			return nil, fmt.Errorf("remote %s failed! e: %v", cmd, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			// escaped file names are prefixed with a backslash
+			fields := strings.Fields(strings.TrimPrefix(scanner.Text(), "\\"))
+			if len(fields) == 0 {
+				continue
+			}
+			sums = append(sums, strings.ToLower(fields[0]))
+		}
+	}
+	if len(sums) != len(paths) {
+		return nil, fmt.Errorf("remote %s returned %d sums, expect %d", cmd, len(sums), len(paths))
+	}
+	return sums, nil
+}
+
+func (scp *SCP) verify(typ VerifyType, sums []checksum) error {
+	if len(sums) == 0 {
+		return nil
+	}
+	paths := make([]string, len(sums))
+	for i := range sums {
+		paths[i] = sums[i].remote
+	}
+	remote, err := scp.RemoteSum(typ, paths...)
+	if err != nil {
+		return err
+	}
+	for i := range sums {
+		if sums[i].sum != remote[i] {
+			return fmt.Errorf("verify %s failed! remote:[%s] local:%s remote:%s", typ, sums[i].remote, sums[i].sum, remote[i])
+		}
+	}
+	return nil
+}
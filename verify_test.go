@@ -0,0 +1,86 @@
+package scpw
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestNewVerifyHash(t *testing.T) {
+	for typ, sum := range map[VerifyType]string{
+		SHA256: "9f64a747e1b97f131fabb6b447296c9b6f0201e79fb3c5356e6c77e89b6a806a",
+		MD5:    "08d6c05a21512a79a1dfeb9d2a8f262f",
+		XXHASH: "542620e3a2a92ed1",
+	} {
+		h, err := NewVerifyHash(typ)
+		assert.Nil(t, err)
+		_, err = io.Copy(hashWriter(io.Discard, h), bytes.NewReader([]byte{1, 2, 3, 4}))
+		assert.Nil(t, err)
+		assert.Equal(t, sum, sumOf(h), typ)
+	}
+
+	_, err := NewVerifyHash("crc32")
+	assert.NotNil(t, err)
+}
+
+func TestVerifyOf(t *testing.T) {
+	node := &Node{Verify: SHA256}
+	assert.Equal(t, SHA256, node.VerifyOf(LRMap{}))
+	assert.Equal(t, MD5, node.VerifyOf(LRMap{Verify: MD5}))
+}
+
+func TestContextNewHash(t *testing.T) {
+	h, err := Context{}.newHash()
+	assert.Nil(t, err)
+	assert.Nil(t, h)
+
+	r := hashReader(bytes.NewReader([]byte{1}), nil)
+	assert.NotNil(t, r)
+}
+
+func TestPutGetVerify(t *testing.T) {
+	p := NewProgress()
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+
+	for _, typ := range []VerifyType{SHA256, MD5} {
+		ctx := Context{Ctx: context.Background(), Bar: p.NewInfiniteByesBar(""), Verify: typ}
+		local, remote := RandName(tmpDir), RandName(tmpDir)
+		require.Nil(t, writeFile(local))
+		assert.Nil(t, scpwCli.Put(ctx, local, remote))
+
+		got := RandName(tmpDir)
+		assert.Nil(t, scpwCli.Get(ctx, got, remote))
+		assertSameFile(t, local, got)
+
+		remoteDir := RandName(tmpDir)
+		require.Nil(t, mkdir(remoteDir))
+		assert.Nil(t, scpwCli.PutAll(ctx, baseLocalDir, remoteDir))
+
+		localDir := RandName(tmpDir)
+		require.Nil(t, mkdir(localDir))
+		assert.Nil(t, scpwCli.GetAll(ctx, localDir, baseRemoteDir))
+	}
+}
+
+func TestRemoteSumMismatch(t *testing.T) {
+	ssh, err := NewSSH(testNode)
+	require.Nil(t, err)
+	defer ssh.Close()
+	scpwCli := NewSCP(ssh, true)
+	remote := RandName(tmpDir)
+	require.Nil(t, writeFile(remote))
+
+	sums, err := scpwCli.RemoteSum(SHA256, remote)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"9f64a747e1b97f131fabb6b447296c9b6f0201e79fb3c5356e6c77e89b6a806a"}, sums)
+
+	assert.NotNil(t, scpwCli.verify(SHA256, []checksum{{remote: remote, sum: "0000"}}))
+	_, err = scpwCli.RemoteSum(SHA256, RandName(tmpDir))
+	assert.NotNil(t, err)
+}